@@ -0,0 +1,119 @@
+//  Copyright 2015 by Leipzig University Library, http://ub.uni-leipzig.de
+//                    The Finc Authors, http://finc.info
+//                    Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+//
+package oaimi
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// windows1252 maps the bytes 0x80 to 0x9F, that differ from ISO-8859-1.
+// Undefined bytes are mapped to the corresponding C1 control character.
+var windows1252 = [32]rune{
+	0x20AC, 0x0081, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008D, 0x017D, 0x008F,
+	0x0090, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0x009D, 0x017E, 0x0178,
+}
+
+// iso885915 lists the bytes, that differ from ISO-8859-1.
+var iso885915 = map[byte]rune{
+	0xA4: 0x20AC, 0xA6: 0x0160, 0xA8: 0x0161, 0xB4: 0x017D,
+	0xB8: 0x017E, 0xBC: 0x0152, 0xBD: 0x0153, 0xBE: 0x0178,
+}
+
+// charsetTable returns the mapping from bytes to runes for a single byte
+// encoding.
+func charsetTable(label string) (*[256]rune, bool) {
+	var table [256]rune
+	for i := range table {
+		table[i] = rune(i)
+	}
+	switch strings.ToLower(strings.TrimSpace(label)) {
+	case "iso-8859-1", "iso8859-1", "iso_8859-1", "latin1", "latin-1", "l1", "us-ascii", "ascii":
+	case "windows-1252", "cp1252", "x-cp1252":
+		for i, r := range windows1252 {
+			table[0x80+i] = r
+		}
+	case "iso-8859-15", "iso8859-15", "iso_8859-15", "latin9", "latin-9":
+		for b, r := range iso885915 {
+			table[b] = r
+		}
+	default:
+		return nil, false
+	}
+	return &table, true
+}
+
+// isUTF8 reports whether a label names UTF-8.
+func isUTF8(label string) bool {
+	switch strings.ToLower(strings.TrimSpace(label)) {
+	case "utf-8", "utf8":
+		return true
+	}
+	return false
+}
+
+// CharsetReader converts input in the given encoding to UTF-8. It supports
+// ISO-8859-1, ISO-8859-15, Windows-1252 and US-ASCII and can be used as
+// CharsetReader of a xml.Decoder.
+func CharsetReader(label string, input io.Reader) (io.Reader, error) {
+	if isUTF8(label) {
+		return input, nil
+	}
+	table, ok := charsetTable(label)
+	if !ok {
+		return nil, fmt.Errorf("unsupported charset: %s", label)
+	}
+	return &transcoder{r: bufio.NewReader(input), table: table}, nil
+}
+
+// transcoder converts a single byte encoding to UTF-8.
+type transcoder struct {
+	r       *bufio.Reader
+	table   *[256]rune
+	pending []byte
+}
+
+func (t *transcoder) Read(p []byte) (n int, err error) {
+	var buf [utf8.UTFMax]byte
+	for n < len(p) {
+		if len(t.pending) > 0 {
+			k := copy(p[n:], t.pending)
+			t.pending, n = t.pending[k:], n+k
+			continue
+		}
+		b, err := t.r.ReadByte()
+		if err != nil {
+			if n > 0 && err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+		k := utf8.EncodeRune(buf[:], t.table[b])
+		t.pending = append(t.pending[:0], buf[:k]...)
+	}
+	return n, nil
+}
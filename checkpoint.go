@@ -0,0 +1,81 @@
+//  Copyright 2015 by Leipzig University Library, http://ub.uni-leipzig.de
+//                    The Finc Authors, http://finc.info
+//                    Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+//
+package oaimi
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// checkpointSuffix is appended to the name of a shard, to get the name of
+// its checkpoint file.
+const checkpointSuffix = ".checkpoint"
+
+// resumableWriter can persist the data written so far and discard data
+// written after a checkpoint, like a file created with CreateResumableFile.
+type resumableWriter interface {
+	io.Writer
+	// Sync persists the data written so far and returns its size.
+	Sync() (int64, error)
+	// Truncate discards everything written after size.
+	Truncate(size int64) error
+}
+
+// checkpoint records the progress of a list request sequence.
+type checkpoint struct {
+	// URL of the first request of the sequence.
+	URL string `json:"url"`
+	// Token is the resumption token for the next page.
+	Token string `json:"token"`
+	// Pages is the number of pages written.
+	Pages int `json:"pages"`
+	// Size of the output after the last page.
+	Size int64 `json:"size"`
+}
+
+// readCheckpoint reads a checkpoint. A missing file is not an error, the
+// checkpoint is nil in this case.
+func readCheckpoint(filename string) (*checkpoint, error) {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// writeCheckpoint persists a checkpoint.
+func writeCheckpoint(filename string, cp checkpoint) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(filename, b, 0644)
+}
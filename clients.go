@@ -23,9 +23,13 @@
 package oaimi
 
 import (
+	"bytes"
+	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
@@ -35,6 +39,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/jinzhu/now"
 	"github.com/mitchellh/go-homedir"
 	"github.com/sethgrid/pester"
 )
@@ -46,51 +51,269 @@ type HttpRequestDoer interface {
 }
 
 // Client is a simple client, that can turn a OAI request into a OAI response.
+// Requests are retried after transport errors and after 503 Service
+// Unavailable responses, which repositories use for flow control (3.1.2.3).
 type Client struct {
 	// client is a delegate for HTTP requests.
 	doer HttpRequestDoer
+	// MaxRetries is the number of times a failed request is repeated.
+	MaxRetries int
+	// MaxRetryAfter caps the time to wait before a retry.
+	MaxRetryAfter time.Duration
+	// Limiter limits requests per host, if not nil. A pause requested by a
+	// repository with Retry-After applies to all clients sharing a limiter.
+	Limiter *HostLimiter
+	// Sanitize converts responses in legacy encodings to UTF-8, removes
+	// characters not allowed in XML and replaces invalid UTF-8.
+	Sanitize bool
+	// Report is called with the repairs of a sanitized response, if any.
+	// Repairs are logged in verbose mode, if Report is nil.
+	Report func(Repairs)
+	// stats collects the HTTP status and number of pages, if not nil.
+	stats *harvestStats
+}
+
+// harvestStats describes a request sequence, for the cache manifest.
+type harvestStats struct {
+	// Status is the HTTP status of the last response.
+	Status int
+	// Pages is the number of pages written, including resumed ones.
+	Pages int
 }
 
 // NewClient creates a new OAI client with a user supplied http client, e.g.
 // pester.Client, http.DefaultClient.
 func NewClientDoer(doer HttpRequestDoer) Client {
-	return Client{doer: doer}
+	return Client{
+		doer:          doer,
+		MaxRetries:    DefaultMaxRetries,
+		MaxRetryAfter: DefaultMaxRetryAfter,
+		Limiter:       DefaultHostLimiter,
+	}
 }
 
-// NewClient create a default client with resilient HTTP client.
+// NewClient create a default client with resilient HTTP client. Retries of
+// transport errors and server errors are left to the OAI client, which backs
+// off exponentially and knows about Retry-After.
 func NewClient() Client {
 	c := pester.New()
 	c.Timeout = 5 * time.Minute
-	c.MaxRetries = 8
-	c.Backoff = pester.ExponentialBackoff
-	return Client{doer: c}
+	c.MaxRetries = 1
+	return NewClientDoer(c)
+}
+
+// backoff returns the time to wait before a retry, if the server did not
+// suggest one.
+func (c Client) backoff(attempt int) time.Duration {
+	d := time.Duration(1<<uint(attempt)) * time.Second
+	if c.MaxRetryAfter > 0 && d > c.MaxRetryAfter {
+		return c.MaxRetryAfter
+	}
+	return d
+}
+
+// open executes the HTTP request for a given OAI request and returns the
+// response body. The caller is responsible for closing the body.
+func (c Client) open(ctx context.Context, req Request) (io.ReadCloser, error) {
+	link, err := req.URL()
+	if err != nil {
+		return nil, err
+	}
+	return c.openURL(ctx, link)
+}
+
+// openURL is like open, but takes a request URL, which need not be a valid
+// OAI request.
+func (c Client) openURL(ctx context.Context, link string) (io.ReadCloser, error) {
+	ref, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		if Verbose {
+			log.Println(link)
+		}
+		release := func() {}
+		if c.Limiter != nil {
+			if release, err = c.Limiter.Wait(ctx, ref.Host); err != nil {
+				return nil, err
+			}
+		}
+		hreq, err := http.NewRequestWithContext(ctx, "GET", link, nil)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		hreq.Header.Set("User-Agent", UserAgent)
+		resp, err := c.doer.Do(hreq)
+		if err == nil && c.stats != nil {
+			c.stats.Status = resp.StatusCode
+		}
+		if err == nil && !retryStatus(resp.StatusCode) {
+			body := resp.Body
+			if c.Sanitize {
+				body = newSanitizer(body, link, c.report)
+			}
+			return releaseBody{ReadCloser: body, release: release}, nil
+		}
+		release()
+		if err != nil {
+			if ctx.Err() != nil || attempt >= c.MaxRetries {
+				return nil, err
+			}
+			wait := c.backoff(attempt)
+			if Verbose {
+				log.Printf("retrying in %s: %s", wait, err)
+			}
+			if err := sleep(ctx, wait); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		resp.Body.Close()
+		if attempt >= c.MaxRetries {
+			switch resp.StatusCode {
+			case http.StatusServiceUnavailable, http.StatusTooManyRequests:
+				return nil, ErrServiceUnavailable
+			}
+			return nil, fmt.Errorf("%s: %s", resp.Status, link)
+		}
+		wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		if !ok {
+			wait = c.backoff(attempt)
+		}
+		if c.MaxRetryAfter > 0 && wait > c.MaxRetryAfter {
+			wait = c.MaxRetryAfter
+		}
+		if Verbose {
+			log.Printf("%s, retrying in %s", resp.Status, wait)
+		}
+		if c.Limiter != nil {
+			c.Limiter.Pause(ref.Host, time.Now().Add(wait))
+		} else if err := sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// retryStatus reports whether a request, that has been answered with the
+// given HTTP status, should be repeated. Besides 503 and 429, which may come
+// with a Retry-After header, all server errors are considered temporary.
+func retryStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// report passes on repairs of a sanitized response.
+func (c Client) report(r Repairs) {
+	switch {
+	case c.Report != nil:
+		c.Report(r)
+	case Verbose:
+		log.Printf("repaired %s", r)
+	}
+}
+
+// sleep waits for the given duration or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Do takes an OAI request and turns it into at most one single OAI response.
 func (c Client) Do(req Request) (Response, error) {
-	var response Response
+	return c.DoContext(context.Background(), req)
+}
+
+// DoContext is like Do, but the request can be cancelled through the context.
+func (c Client) DoContext(ctx context.Context, req Request) (Response, error) {
+	response, _, err := c.fetch(ctx, req)
+	return response, err
+}
+
+// GetRecord retrieves a single record with a GetRecord request. The response
+// body is returned as well, converted to UTF-8 and without XML declaration, so
+// that several bodies can be concatenated.
+func (c Client) GetRecord(req Request) (Record, []byte, error) {
+	return c.GetRecordContext(context.Background(), req)
+}
 
+// GetRecordContext is like GetRecord, but the request can be cancelled
+// through the context.
+func (c Client) GetRecordContext(ctx context.Context, req Request) (Record, []byte, error) {
+	if req.Verb == "" {
+		req.Verb = "GetRecord"
+	}
+	if req.Verb != "GetRecord" {
+		return Record{}, nil, ErrBadVerb
+	}
+	resp, page, err := c.fetch(ctx, req)
+	if err != nil {
+		return resp.GetRecord.Record, page, err
+	}
+	page, err = normalizePage(page)
+	return resp.GetRecord.Record, page, err
+}
+
+// fetch executes a request and returns the decoded response together with
+// the response body.
+func (c Client) fetch(ctx context.Context, req Request) (Response, []byte, error) {
 	link, err := req.URL()
 	if err != nil {
-		return response, err
+		return Response{}, nil, err
 	}
+	return c.fetchURL(ctx, link)
+}
 
-	if Verbose {
-		log.Println(link)
+// fetchURL is like fetch, but takes a request URL.
+func (c Client) fetchURL(ctx context.Context, link string) (Response, []byte, error) {
+	b, err := c.readURL(ctx, link)
+	if err != nil {
+		return Response{}, nil, err
 	}
+	response, err := decodeResponse(b)
+	if _, ok := err.(OAIError); err != nil && !ok {
+		return response, nil, err
+	}
+	return response, b, err
+}
 
-	hreq, err := http.NewRequest("GET", link, nil)
+// fetchPage executes a request and returns the response body converted to
+// UTF-8, see normalizePage. Unlike fetch, the body is not decoded.
+func (c Client) fetchPage(ctx context.Context, req Request) ([]byte, error) {
+	link, err := req.URL()
 	if err != nil {
-		return response, err
+		return nil, err
 	}
-	hreq.Header.Set("User-Agent", UserAgent)
-	resp, err := c.doer.Do(hreq)
+	b, err := c.readURL(ctx, link)
 	if err != nil {
-		return response, err
+		return nil, err
+	}
+	return normalizePage(b)
+}
+
+// readURL returns the response body of a request URL.
+func (c Client) readURL(ctx context.Context, link string) ([]byte, error) {
+	body, err := c.openURL(ctx, link)
+	if err != nil {
+		return nil, err
 	}
-	defer resp.Body.Close()
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
 
-	decoder := xml.NewDecoder(resp.Body)
+// decodeResponse decodes a response body. An OAI error is returned as
+// OAIError.
+func decodeResponse(b []byte) (Response, error) {
+	var response Response
+	decoder := xml.NewDecoder(bytes.NewReader(b))
+	decoder.CharsetReader = CharsetReader
 	if err := decoder.Decode(&response); err != nil {
 		return response, err
 	}
@@ -98,10 +321,34 @@ func (c Client) Do(req Request) (Response, error) {
 		e := response.Error
 		return response, OAIError{Code: e.Code, Message: e.Message}
 	}
-
 	return response, nil
 }
 
+// normalizePage prepares a response body for concatenation: The XML
+// declaration is dropped and a body in another encoding is converted to
+// UTF-8.
+func normalizePage(b []byte) ([]byte, error) {
+	b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+	if !bytes.HasPrefix(b, []byte("<?xml")) {
+		return b, nil
+	}
+	end := bytes.Index(b, []byte("?>"))
+	if end < 0 {
+		return b, nil
+	}
+	decl := b[:end+2]
+	b = b[end+2:]
+	m := encodingDecl.FindSubmatch(decl)
+	if m == nil || isUTF8(string(m[1])) {
+		return b, nil
+	}
+	r, err := CharsetReader(string(m[1]), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
 // BatchingClient takes a single OAI request but will do more the one HTTP
 // request to fulfill it, if necessary.
 type BatchingClient struct {
@@ -139,10 +386,20 @@ func getResumptionToken(resp Response) string {
 // Do will turn a single request into a single response by combining many
 // responses into a single one. This is potentially very memory consuming.
 func (c *BatchingClient) Do(req Request) (resp Response, err error) {
-	resp, err = c.client.Do(req)
+	return c.DoContext(context.Background(), req)
+}
+
+// DoContext is like Do, but the request can be cancelled through the context.
+// If the repository does not accept a resumption token anymore, the list is
+// requested again from the datestamp of the last record received, skipping
+// records already received.
+func (c *BatchingClient) DoContext(ctx context.Context, req Request) (resp Response, err error) {
+	resp, err = c.client.DoContext(ctx, req)
 	if err != nil {
 		return resp, err
 	}
+	recovery := newListRecovery(req)
+	recovery.filter(&resp)
 	var aggregate = resp
 	i := 1
 	switch req.Verb {
@@ -156,10 +413,22 @@ func (c *BatchingClient) Do(req Request) (resp Response, err error) {
 				return aggregate, err
 			}
 			req.ResumptionToken = token
-			resp, err = c.client.Do(req)
+			if expires := tokenExpiry(resp); !expires.IsZero() && time.Now().After(expires) {
+				if r, ok := recovery.restart(); ok {
+					req = r
+				}
+			}
+			resp, err = c.client.DoContext(ctx, req)
+			if err != nil && isBadResumptionToken(err) && req.ResumptionToken != "" {
+				if r, ok := recovery.restart(); ok {
+					req = r
+					resp, err = c.client.DoContext(ctx, req)
+				}
+			}
 			if err != nil {
 				return aggregate, err
 			}
+			recovery.filter(&resp)
 			switch req.Verb {
 			case "ListIdentifiers":
 				aggregate.ListIdentifiers.Header = append(aggregate.ListIdentifiers.Header,
@@ -185,6 +454,12 @@ type WriterClient struct {
 	// loop due to broken resumptionToken implementations (e.g.
 	// http://goo.gl/KFb9iM). Zero means no limit.
 	MaxRequests int
+	// Checkpoint is the name of a file, where the progress of list requests
+	// is recorded after each page, if the writer supports it (see
+	// CreateResumableFile). A later request with the same URL continues after
+	// the last recorded page. If the recorded resumption token is not
+	// accepted anymore, the list is requested from the start.
+	Checkpoint string
 	// client is a actual client used for executing the requests.
 	client Client
 	// w is where the XML gets written.
@@ -195,15 +470,6 @@ func NewWriterClient(w io.Writer) WriterClient {
 	return WriterClient{client: NewClient(), w: w, MaxRequests: 16384}
 }
 
-func (c WriterClient) writeResponse(resp Response) error {
-	b, err := xml.Marshal(resp)
-	if err != nil {
-		return err
-	}
-	_, err = c.w.Write(b)
-	return err
-}
-
 // startDocument will write the root start tag, if one is defined.
 func (c WriterClient) startDocument() error {
 	if c.RootTag != "" {
@@ -226,42 +492,126 @@ func (c WriterClient) endDocument() error {
 
 // Do will execute a request and write all XML to the writer.
 func (c WriterClient) Do(req Request) error {
-	resp, err := c.client.Do(req)
+	return c.DoContext(context.Background(), req)
+}
+
+// DoContext is like Do, but the request can be cancelled through the context.
+func (c WriterClient) DoContext(ctx context.Context, req Request) error {
+	var rw resumableWriter
+	switch req.Verb {
+	case "ListIdentifiers", "ListRecords", "ListSets":
+		if c.Checkpoint != "" {
+			rw, _ = c.w.(resumableWriter)
+		}
+	}
+	start, err := req.URL()
 	if err != nil {
 		return err
 	}
-
-	if err := c.startDocument(); err != nil {
+	var cp *checkpoint
+	if rw != nil {
+		if cp, err = readCheckpoint(c.Checkpoint); err != nil {
+			return err
+		}
+		if cp != nil && cp.URL != start {
+			cp = nil
+		}
+	}
+	// restart discards any output and begins with the first page
+	restart := func() error {
+		if rw != nil {
+			if err := rw.Truncate(0); err != nil {
+				return err
+			}
+		}
+		req.ResumptionToken = ""
+		return c.startDocument()
+	}
+	recovery := newListRecovery(req)
+	var i int
+	if cp != nil {
+		if Verbose {
+			log.Printf("resuming %s after %d pages", start, cp.Pages)
+		}
+		if err := rw.Truncate(cp.Size); err != nil {
+			return err
+		}
+		req.ResumptionToken, i = cp.Token, cp.Pages
+	} else if err := restart(); err != nil {
 		return err
 	}
 	defer c.endDocument()
 
-	if err := c.writeResponse(resp); err != nil {
-		return err
-	}
-	i := 1
-	switch req.Verb {
-	case "ListIdentifiers", "ListRecords", "ListSets":
-		for {
-			if i == c.MaxRequests {
-				return ErrTooManyRequests
+	var expires time.Time
+	for {
+		if c.MaxRequests > 0 && i == c.MaxRequests {
+			return ErrTooManyRequests
+		}
+		// a token, that expired already, would only cause a badResumptionToken
+		if req.ResumptionToken != "" && !expires.IsZero() && time.Now().After(expires) {
+			if r, ok := recovery.restart(); ok {
+				req, expires = r, time.Time{}
+				continue
 			}
-			token := getResumptionToken(resp)
-			if token == "" {
-				return nil
+		}
+		// the page is converted first, so items can be cut by offset
+		var resp Response
+		page, err := c.client.fetchPage(ctx, req)
+		if err == nil {
+			resp, page, err = recovery.decodePage(page)
+		}
+		if err != nil {
+			if !isBadResumptionToken(err) || req.ResumptionToken == "" {
+				return err
 			}
-			req.ResumptionToken = token
-			resp, err = c.client.Do(req)
+			if r, ok := recovery.restart(); ok {
+				req = r
+				continue
+			}
+			if cp != nil && req.ResumptionToken == cp.Token {
+				if Verbose {
+					log.Printf("checkpoint expired, restarting %s", start)
+				}
+				cp, i = nil, 0
+				if err := restart(); err != nil {
+					return err
+				}
+				continue
+			}
+			return err
+		}
+		if _, err := c.w.Write(page); err != nil {
+			return err
+		}
+		i++
+		if c.client.stats != nil {
+			c.client.stats.Pages = i
+		}
+		expires = tokenExpiry(resp)
+		var token string
+		switch req.Verb {
+		case "ListIdentifiers", "ListRecords", "ListSets":
+			token = getResumptionToken(resp)
+		}
+		if token == "" {
+			if rw != nil {
+				if err := os.Remove(c.Checkpoint); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+			return nil
+		}
+		if rw != nil {
+			size, err := rw.Sync()
 			if err != nil {
 				return err
 			}
-			if err := c.writeResponse(resp); err != nil {
+			if err := writeCheckpoint(c.Checkpoint, checkpoint{URL: start, Token: token, Pages: i, Size: size}); err != nil {
 				return err
 			}
-			i++
 		}
+		req.ResumptionToken = token
 	}
-	return nil
 }
 
 // CachingClient will write XML to a given writer. This client encapsulates
@@ -274,6 +624,32 @@ type CachingClient struct {
 	NameSpaces map[string]string
 	// CacheDir stores the directory, where all the downloads go.
 	CacheDir string
+	// Store keeps the shards, if set, instead of CacheDir, e.g. to share a
+	// cache between hosts.
+	Store CacheStore
+	// Adaptive chooses window sizes based on the number of records in a
+	// window, instead of using weekly windows. The chosen windows are stored
+	// in the cache dir and reused by subsequent requests. Adaptive and weekly
+	// windows should not be mixed in a single cache dir.
+	Adaptive bool
+	// MaxShardRecords is the number of records, above which an adaptive
+	// window is split further.
+	MaxShardRecords int
+	// Grace is the time after the end of a window, during which a shard is
+	// still considered provisional. Provisional shards are harvested again on
+	// the next request, since the repository might have added records since.
+	Grace time.Duration
+	// Format of the output of list requests, FormatXML, FormatJSONL or
+	// FormatTSV. The default is FormatXML.
+	Format string
+	// About restricts the output of list requests to records with an about
+	// container, that contains the given text, e.g. a rights statement URL.
+	// Matching records are written as record elements.
+	About string
+	// Sanitize repairs responses before decoding, see Client.
+	Sanitize bool
+	// Report is called with the repairs of a sanitized response, if any.
+	Report func(Repairs)
 	// w is the target writer, where all content is written.
 	w io.Writer
 }
@@ -296,21 +672,46 @@ func NewCachingClientDir(w io.Writer, dir string) CachingClient {
 		"dc":     "http://purl.org/dc/elements/1.1/",
 		"oai_dc": "http://www.openarchives.org/OAI/2.0/oai_dc/",
 	}
-	return CachingClient{CacheDir: dir, w: w, NameSpaces: defaultns}
+	return CachingClient{
+		CacheDir:        dir,
+		w:               w,
+		NameSpaces:      defaultns,
+		MaxShardRecords: DefaultMaxShardRecords,
+		Grace:           DefaultGrace,
+	}
 }
 
-// RequestCacheDir returns the cache directory for a given request.
+// RequestCacheDir returns the cache directory for a given request, which
+// does not depend on from and until. Fails with ErrNoCacheDir, if the shards
+// are kept in a store, that is not a directory.
 func (c CachingClient) RequestCacheDir(req Request) (string, error) {
-	pth, err := c.getCachePath(req)
+	return c.shardDir(req)
+}
+
+// fileStore returns the store of the client, if it keeps the shards in a
+// directory.
+func (c CachingClient) fileStore() (FileStore, bool) {
+	return asFileStore(c.store())
+}
+
+// shardDir returns the directory of the shards of a list request, which does
+// not depend on from and until. Without prefix, the directory of the verb is
+// returned.
+func (c CachingClient) shardDir(req Request) (string, error) {
+	fs, ok := c.fileStore()
+	if !ok {
+		return "", ErrNoCacheDir
+	}
+	prefix, err := shardPrefix(req)
 	if err != nil {
 		return "", err
 	}
-	return path.Dir(pth), nil
+	return fs.path(prefix), nil
 }
 
-// getCachePath assembles a destination path for the cache file for a given
-// request. This method does not create any file or directory.
-func (c CachingClient) getCachePath(req Request) (string, error) {
+// shardPrefix returns the store key prefix of the shards of a list request,
+// the slash separated equivalent of shardDir.
+func shardPrefix(req Request) (string, error) {
 	ref, err := url.Parse(req.Endpoint)
 	if err != nil {
 		return "", err
@@ -320,18 +721,159 @@ func (c CachingClient) getCachePath(req Request) (string, error) {
 	}
 	switch req.Verb {
 	case "ListRecords", "ListSets", "ListIdentifiers":
-		switch {
-		case req.From.IsZero() || req.Until.IsZero():
-			return "", ErrMissingFromOrUntil
-		default:
-			name := fmt.Sprintf("%s-%s.xml.gz", req.From.Format("2006-01-02"), req.Until.Format("2006-01-02"))
-			sub := path.Join(ref.Host, ref.Path, req.Verb, req.Prefix)
-			return filepath.Join(c.CacheDir, sub, name), nil
-		}
+		return path.Join(ref.Host, ref.Path, req.Verb, req.Prefix, setDir(req.Set)), nil
 	}
 	return "", ErrCannotCreatePath
 }
 
+// shardKey returns the store key of the shard of a list request.
+func shardKey(req Request) (string, error) {
+	prefix, err := shardPrefix(req)
+	if err != nil {
+		return "", err
+	}
+	if req.From.IsZero() || req.Until.IsZero() {
+		return "", ErrMissingFromOrUntil
+	}
+	return path.Join(prefix, shardName(req)+".xml.gz"), nil
+}
+
+// store returns the store of the client, which defaults to the cache dir.
+func (c CachingClient) store() CacheStore {
+	if c.Store != nil {
+		return c.Store
+	}
+	return FileStore{Dir: c.CacheDir}
+}
+
+// MigrateCache moves shards of a set, that have been harvested with an older
+// version of oaimi, into the shard directory of the set. Older versions did
+// not include the set in the cache path, so the shards of all sets and of the
+// whole repository ended up in a single directory. A shard is moved, if all
+// its records belong to the set of the request or one of its subsets. Shards
+// of the whole repository and empty shards stay where they are. The manifest
+// entries of moved shards are moved, too. Returns the number of moved shards.
+func (c CachingClient) MigrateCache(req Request) (int, error) {
+	if req.Set == "" {
+		return 0, nil
+	}
+	dst, err := shardPrefix(req)
+	if err != nil {
+		return 0, err
+	}
+	legacy := req
+	legacy.Set = ""
+	src, err := shardPrefix(legacy)
+	if err != nil {
+		return 0, err
+	}
+	store := c.store()
+	keys, err := store.List(src)
+	if err != nil {
+		return 0, err
+	}
+	m, err := ReadManifest(store, src)
+	if err != nil {
+		return 0, err
+	}
+	var shards []string
+	for _, key := range keys {
+		// shards of sets, that have been migrated already, are below src, too
+		if path.Dir(key) == src && strings.HasSuffix(key, ".xml.gz") {
+			shards = append(shards, key)
+		}
+	}
+	var moved int
+	var infos []ShardInfo
+	removed := make(map[string]string)
+	for _, key := range shards {
+		var ok bool
+		if ok, err = shardInSet(store, key, req.Set); err != nil {
+			break
+		}
+		if !ok {
+			continue
+		}
+		if err = moveShard(store, key, path.Join(dst, path.Base(key))); err != nil {
+			break
+		}
+		moved++
+		removed[key] = "migrated"
+		if si, ok := m.find(path.Base(key)); ok {
+			infos = append(infos, si)
+		}
+	}
+	// the manifest entries move with the shards, even if not all shards
+	// could be moved
+	if req.Granularity == "" {
+		req.Granularity = m.Granularity
+	}
+	if merr := updateManifest(store, req, infos); merr != nil && err == nil {
+		err = merr
+	}
+	if moved > 0 {
+		if merr := pruneManifests(store, map[string]int{src: len(shards) - moved}, removed); merr != nil && err == nil {
+			err = merr
+		}
+	}
+	return moved, err
+}
+
+// errNotInSet stops reading a shard at the first record outside a set.
+var errNotInSet = errors.New("record not in set")
+
+// shardInSet reports whether a shard has records and all of them belong to a
+// set or one of its subsets. Deleted records without set specs are ignored,
+// since repositories may leave them out.
+func shardInSet(store CacheStore, key, spec string) (bool, error) {
+	var n int
+	err := eachRecord(store, []string{key}, func(_ position, rec Record) error {
+		if rec.Header.Deleted() && len(rec.Header.SetSpec) == 0 {
+			return nil
+		}
+		for _, s := range rec.Header.SetSpec {
+			if s == spec || strings.HasPrefix(s, spec+":") {
+				n++
+				return nil
+			}
+		}
+		return errNotInSet
+	})
+	if err == errNotInSet {
+		return false, nil
+	}
+	return n > 0, err
+}
+
+// moveShard moves a shard to a new key. Files of a FileStore are renamed, so
+// the shard keeps its modification time, other stores copy the shard, which
+// counts as a new retrieval then.
+func moveShard(store CacheStore, src, dst string) error {
+	if fs, ok := asFileStore(store); ok {
+		if err := mkdirAll(filepath.Dir(fs.path(dst))); err != nil {
+			return err
+		}
+		return os.Rename(fs.path(src), fs.path(dst))
+	}
+	rc, err := store.Open(src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	w, err := store.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, rc); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return store.Delete(src)
+}
+
 // startDocument inserts a root tag, if given.
 func (c CachingClient) startDocument() error {
 	if c.RootTag == "" {
@@ -360,72 +902,278 @@ func (c CachingClient) endDocument() error {
 	return nil
 }
 
+// provisional reports whether a shard, that has been last modified at the
+// given time, might miss records, because it was written before the window
+// was closed, including the grace period.
+func (c CachingClient) provisional(modified, until time.Time) bool {
+	return !modified.After(until.Add(c.Grace))
+}
+
 // maybeRetrieve retrieves and stores the response for a given request, if it
-// is not already cached. Returns the cache filename and any error.
-func (c CachingClient) maybeRetrieve(req Request) (fn string, err error) {
-	fn, err = c.getCachePath(req)
+// is not already cached or the cached shard is provisional. Returns the store
+// key of the shard, the manifest entry of a retrieval, if one took place, and
+// any error. If the retrieval fails or is cancelled, no shard is left behind
+// and an existing shard is kept.
+func (c CachingClient) maybeRetrieve(ctx context.Context, req Request) (key string, info *ShardInfo, err error) {
+	return c.retrieve(ctx, req, false)
+}
+
+// retrieve is like maybeRetrieve, but with force, a cached shard is retrieved
+// again in any case, unless another process has replaced it meanwhile.
+func (c CachingClient) retrieve(ctx context.Context, req Request, force bool) (key string, info *ShardInfo, err error) {
+	key, err = shardKey(req)
 	if err != nil {
-		return fn, err
-	}
-	// retrieve records if we don't already have
-	if _, err := os.Stat(fn); os.IsNotExist(err) {
-		file := CreateMaybeCompressedFile(fn)
-		client := NewWriterClient(file)
-		if err := client.Do(req); err != nil {
-			switch err := err.(type) {
-			case OAIError:
-				if err.Code != "noRecordsMatch" {
-					return fn, err
-				}
-			default:
-				return fn, err
+		return key, nil, err
+	}
+	store := c.store()
+	modified, ok, err := store.Exists(key)
+	switch {
+	case err != nil:
+		return key, nil, err
+	case !ok, force:
+	case c.provisional(modified, req.Until):
+		if Verbose {
+			log.Printf("refreshing provisional shard %s", key)
+		}
+	default:
+		return key, nil, nil
+	}
+	// wait for other processes retrieving the same shard and reuse their
+	// result, if any
+	checkLocking(store)
+	if ls, ok := store.(lockingStore); ok {
+		unlock, err := ls.Lock(ctx, key)
+		if err != nil {
+			return key, nil, err
+		}
+		defer unlock()
+		current, ok, err := store.Exists(key)
+		if err != nil {
+			return key, nil, err
+		}
+		if ok && !current.Equal(modified) {
+			return key, nil, nil
+		}
+	}
+	info = &ShardInfo{
+		Name:      path.Base(key),
+		From:      req.From,
+		Until:     req.Until,
+		Attempted: time.Now(),
+		Version:   Version,
+	}
+	// failed records a failed retrieval; a cancelled one is not recorded,
+	// since it says nothing about the repository
+	failed := func(err error) (string, *ShardInfo, error) {
+		if ctx.Err() != nil {
+			return key, nil, err
+		}
+		info.Error = err.Error()
+		return key, info, err
+	}
+	// retrieve records, the new shard replaces any existing one atomically;
+	// with a resumable store, an interrupted retrieval continues from its
+	// checkpoint on the next run
+	var file ShardWriter
+	var checkpoint string
+	if rs, ok := store.(resumableStore); ok {
+		file, checkpoint, err = rs.CreateResumable(key)
+	} else {
+		file, err = store.Create(key)
+	}
+	if err != nil {
+		return failed(err)
+	}
+	stats := &harvestStats{}
+	client := NewWriterClient(file)
+	client.client = c.client()
+	client.client.stats = stats
+	client.Checkpoint = checkpoint
+	err = client.DoContext(ctx, req)
+	info.Status, info.Pages = stats.Status, stats.Pages
+	if err != nil {
+		switch e := err.(type) {
+		case OAIError:
+			if e.Code != "noRecordsMatch" {
+				file.Abort()
+				return failed(err)
 			}
+			info.NoRecordsMatch = true
+		default:
+			file.Abort()
+			return failed(err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		return failed(err)
+	}
+	if info.Size, info.SHA256, info.Records, err = shardStats(store, key); err != nil {
+		return failed(err)
+	}
+	info.Fetched = time.Now()
+	return key, info, nil
+}
+
+// client returns the client for requests to the repository.
+func (c CachingClient) client() Client {
+	client := NewClient()
+	client.Sanitize, client.Report = c.Sanitize, c.Report
+	return client
+}
+
+// windows returns the windows, a list request is split into.
+func (c CachingClient) windows(ctx context.Context, req Request) ([]Window, error) {
+	if c.Adaptive {
+		return c.adaptiveWindows(ctx, req)
+	}
+	windows := Window{From: req.From, Until: req.Until}.Weekly()
+	// With second granularity, there is no need to start at the beginning
+	// of the day, e.g. when updating from the last datestamp seen, or to
+	// end at the end of the day.
+	if req.Granularity == GranularitySecond && len(windows) > 0 {
+		if req.From.After(windows[0].From) {
+			windows[0].From = req.From
 		}
-		if err := file.Close(); err != nil {
-			return fn, err
+		if last := &windows[len(windows)-1]; req.Until.Before(last.Until) {
+			last.Until = req.Until
 		}
 	}
-	return fn, nil
+	return windows, nil
 }
 
 // Do executes a given request. If the request is not yet cached, the content
 // is retrieved and persisted. Requests are internally split up into weekly
-// windows to reduce load and to latency in case of errors.
+// windows to reduce load and to latency in case of errors, or into adaptive
+// windows, if requested.
 func (c CachingClient) Do(req Request) error {
+	return c.DoContext(context.Background(), req)
+}
+
+// DoContext is like Do, but the request can be cancelled through the context.
+// Windows, that have been completely retrieved before cancellation, stay in
+// the cache.
+func (c CachingClient) DoContext(ctx context.Context, req Request) error {
+	if c.Format == FormatJSONL || c.Format == FormatTSV {
+		c.RootTag = ""
+	}
 	c.startDocument()
 	defer c.endDocument()
 
 	switch req.Verb {
 	case "Identify", "ListMetadataFormats", "ListSets":
 		client := NewWriterClient(c.w)
-		return client.Do(req)
-	case "ListRecords", "ListIdentifiers":
-		req.UseDefaults()
-		windows := Window{From: req.From, Until: req.Until}.Weekly()
-		for _, w := range windows {
-			r := Request{
-				Endpoint: req.Endpoint,
-				Verb:     req.Verb,
-				Prefix:   req.Prefix,
-				Set:      req.Set,
-				From:     w.From,
-				Until:    w.Until,
-			}
-
-			filename, err := c.maybeRetrieve(r)
+		client.client = c.client()
+		return client.DoContext(ctx, req)
+	case "GetRecord":
+		// single records are not cached
+		if (c.Format != "" && c.Format != FormatXML) || c.About != "" {
+			write, err := c.recordWriter(req)
 			if err != nil {
 				return err
 			}
-			file, err := OpenMaybeCompressedFile(filename)
+			rec, _, err := c.client().GetRecordContext(ctx, req)
 			if err != nil {
 				return err
 			}
-			if _, err = io.Copy(c.w, file); err != nil {
+			return write(rec)
+		}
+		client := NewWriterClient(c.w)
+		client.client = c.client()
+		return client.DoContext(ctx, req)
+	case "ListRecords", "ListIdentifiers":
+		if (c.Format != "" && c.Format != FormatXML) || c.About != "" {
+			write, err := c.recordWriter(req)
+			if err != nil {
 				return err
 			}
-			if err := file.Close(); err != nil {
+			return c.eachShard(ctx, req, func(key string, keep func(header) bool) error {
+				return eachRecord(c.store(), []string{key}, func(_ position, rec Record) error {
+					if keep != nil && !keep(rec.Header) {
+						return nil
+					}
+					return write(rec)
+				})
+			})
+		}
+		return c.eachShard(ctx, req, func(key string, keep func(header) bool) error {
+			file, err := c.store().Open(key)
+			if err != nil {
 				return err
 			}
+			defer file.Close()
+			return copyShard(c.w, file, keep)
+		})
+	}
+	return nil
+}
+
+// requestSpan returns the time span, that a list request asks for. Without
+// second granularity, whole days are requested.
+func requestSpan(req Request) Window {
+	if req.Granularity == GranularitySecond {
+		return Window{From: req.From, Until: req.Until}
+	}
+	return Window{From: now.New(req.From).BeginningOfDay(), Until: now.New(req.Until).EndOfDay()}
+}
+
+// datestampFilter returns a function, that reports whether an item has a
+// datestamp within a window. Items with malformed datestamps are kept.
+func datestampFilter(w Window) func(header) bool {
+	return func(h header) bool {
+		t, err := ParseDatestamp(h.Datestamp)
+		if err != nil {
+			return true
+		}
+		return !t.Before(w.From) && !t.After(w.Until)
+	}
+}
+
+// eachShard splits a list request into windows, retrieves the windows, that
+// are not cached yet and calls fn with the store key of each shard, in order.
+// Adaptive windows may extend beyond the request, fn is then passed a
+// function, that reports whether an item is within the request, otherwise
+// nil. Retrievals are recorded in the manifest of the request, also on error.
+func (c CachingClient) eachShard(ctx context.Context, req Request, fn func(key string, keep func(header) bool) error) (err error) {
+	req.UseDefaultsContext(ctx)
+	windows, err := c.windows(ctx, req)
+	if err != nil {
+		return err
+	}
+	span := requestSpan(req)
+	inSpan := datestampFilter(span)
+	var infos []ShardInfo
+	defer func() {
+		if merr := updateManifest(c.store(), req, infos); merr != nil && err == nil {
+			err = merr
+		}
+	}()
+	for _, w := range windows {
+		r := Request{
+			Endpoint:    req.Endpoint,
+			Verb:        req.Verb,
+			Prefix:      req.Prefix,
+			Set:         req.Set,
+			From:        w.From,
+			Until:       w.Until,
+			Granularity: req.Granularity,
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		key, info, err := c.maybeRetrieve(ctx, r)
+		if info != nil {
+			infos = append(infos, *info)
+		}
+		if err != nil {
+			return err
+		}
+		var keep func(header) bool
+		if w.From.Before(span.From) || w.Until.After(span.Until) {
+			keep = inSpan
+		}
+		if err := fn(key, keep); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -0,0 +1,480 @@
+package oaimi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/now"
+	"github.com/miku/oaimi/oaitest"
+)
+
+// testRecords returns n records, one per day starting at 2000-01-01.
+func testRecords(n int) []oaitest.Record {
+	var records []oaitest.Record
+	for i := 0; i < n; i++ {
+		records = append(records, oaitest.Record{
+			Identifier: fmt.Sprintf("r%d", i),
+			Datestamp:  time.Date(2000, 1, 1+i, 0, 0, 0, 0, time.UTC),
+		})
+	}
+	return records
+}
+
+func TestProvisional(t *testing.T) {
+	until := time.Date(2000, 1, 7, 23, 59, 59, 999999999, time.UTC)
+	var tests = []struct {
+		modified    time.Time
+		grace       time.Duration
+		provisional bool
+	}{
+		{time.Date(2000, 1, 5, 0, 0, 0, 0, time.UTC), 0, true},
+		{time.Date(2000, 1, 8, 1, 0, 0, 0, time.UTC), 0, false},
+		{time.Date(2000, 1, 8, 1, 0, 0, 0, time.UTC), 24 * time.Hour, true},
+		{time.Date(2000, 1, 9, 1, 0, 0, 0, time.UTC), 24 * time.Hour, false},
+	}
+	for _, test := range tests {
+		c := CachingClient{Grace: test.grace}
+		if got := c.provisional(test.modified, until); got != test.provisional {
+			t.Errorf("provisional(%v) got %v, want %v", test.modified, got, test.provisional)
+		}
+	}
+}
+
+func TestCachingClientProvisional(t *testing.T) {
+	today := now.New(time.Now().UTC()).BeginningOfDay()
+	past := today.AddDate(0, 0, -30)
+	records := []oaitest.Record{{Identifier: "past", Datestamp: past}, {Identifier: "today", Datestamp: today}}
+	var mu sync.Mutex
+	var froms []string
+	handler := oaitest.NewHandler(oaitest.Config{Records: records})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		froms = append(froms, r.URL.Query().Get("from"))
+		h := handler
+		mu.Unlock()
+		h.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	c := NewCachingClientDir(&buf, t.TempDir())
+	c.Grace = 0
+	req := Request{Endpoint: ts.URL, Verb: "ListRecords", Prefix: "oai_dc", From: past, Until: today}
+	if err := c.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	if len(froms) < 2 {
+		t.Fatalf("got %d requests, want one per week", len(froms))
+	}
+
+	// a record added today must show up, without harvesting past weeks again
+	mu.Lock()
+	handler = oaitest.NewHandler(oaitest.Config{Records: append(records,
+		oaitest.Record{Identifier: "later", Datestamp: today})})
+	froms = nil
+	mu.Unlock()
+	buf.Reset()
+	if err := c.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	if len(froms) != 1 {
+		t.Errorf("got %d requests, want 1 for the current week", len(froms))
+	}
+	week := now.New(today).BeginningOfWeek().Format("2006-01-02")
+	for _, from := range froms {
+		if from < week {
+			t.Errorf("closed window from %s harvested again", from)
+		}
+	}
+	for _, id := range []string{"past", "today", "later"} {
+		if !strings.Contains(buf.String(), "<identifier>"+id+"</identifier>") {
+			t.Errorf("missing %s", id)
+		}
+	}
+}
+
+func TestCachingClientWindowsUntil(t *testing.T) {
+	req := Request{
+		From:  time.Date(2000, 1, 3, 0, 0, 0, 0, time.UTC),
+		Until: time.Date(2000, 1, 12, 12, 0, 0, 0, time.UTC),
+	}
+	for granularity, until := range map[string]time.Time{
+		GranularityDay:    time.Date(2000, 1, 12, 23, 59, 59, 999999999, time.UTC),
+		GranularitySecond: req.Until,
+	} {
+		req.Granularity = granularity
+		windows, err := CachingClient{}.windows(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last := windows[len(windows)-1]; !last.Until.Equal(until) {
+			t.Errorf("windows() with %s got last until %v, want %v", granularity, last.Until, until)
+		}
+	}
+}
+
+// sameDay sets all datestamps to the first one.
+func sameDay(records []oaitest.Record) []oaitest.Record {
+	for i := range records {
+		records[i].Datestamp = records[0].Datestamp
+	}
+	return records
+}
+
+func TestWriterClientRecovery(t *testing.T) {
+	ts := oaitest.NewServer(oaitest.Config{Records: testRecords(10), PageSize: 4,
+		Faults: oaitest.Faults{BadResumptionToken: true}})
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	client := WriterClient{client: NewClientDoer(http.DefaultClient), w: &buf}
+	if err := client.Do(Request{Endpoint: ts.URL, Verb: "ListRecords", Prefix: "oai_dc"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if n := strings.Count(buf.String(), fmt.Sprintf("<identifier>r%d</identifier>", i)); n != 1 {
+			t.Errorf("r%d written %d times, want 1", i, n)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	ts := oaitest.NewServer(oaitest.Config{Name: "Test", Records: testRecords(3)})
+	defer ts.Close()
+
+	client := NewClientDoer(http.DefaultClient)
+	resp, err := client.Do(Request{Endpoint: ts.URL, Verb: "Identify"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Identify.Name != "Test" || resp.Identify.EarliestDatestamp != "2000-01-01" {
+		t.Errorf("Identify got %+v", resp.Identify)
+	}
+	_, err = client.Do(Request{Endpoint: ts.URL, Verb: "ListSets"})
+	if e, ok := err.(OAIError); !ok || e.Code != "noSetHierarchy" {
+		t.Errorf("ListSets got %v, want noSetHierarchy", err)
+	}
+}
+
+func TestBatchingClient(t *testing.T) {
+	var tests = []struct {
+		config oaitest.Config
+		count  int
+		err    error
+	}{
+		{oaitest.Config{Records: testRecords(10), PageSize: 3}, 10, nil},
+		{oaitest.Config{Records: testRecords(10), PageSize: 3,
+			Faults: oaitest.Faults{EndlessTokens: true}}, 0, ErrTooManyRequests},
+		// restarted from the last datestamp after each page
+		{oaitest.Config{Records: testRecords(10), PageSize: 3,
+			Faults: oaitest.Faults{BadResumptionToken: true}}, 10, nil},
+		// restarts do not make progress, if all datestamps are equal
+		{oaitest.Config{Records: sameDay(testRecords(10)), PageSize: 3,
+			Faults: oaitest.Faults{BadResumptionToken: true}}, 0,
+			OAIError{Code: "badResumptionToken", Message: "token expired"}},
+	}
+	for _, test := range tests {
+		ts := oaitest.NewServer(test.config)
+		client := BatchingClient{client: NewClientDoer(http.DefaultClient), MaxRequests: 8}
+		resp, err := client.Do(Request{Endpoint: ts.URL, Verb: "ListRecords", Prefix: "oai_dc"})
+		if err != test.err {
+			t.Errorf("Do() got %v, want %v", err, test.err)
+		}
+		if err == nil && len(resp.ListRecords.Records) != test.count {
+			t.Errorf("Do() got %d records, want %d", len(resp.ListRecords.Records), test.count)
+		}
+		ts.Close()
+	}
+}
+
+func TestCachingClient(t *testing.T) {
+	ts := oaitest.NewServer(oaitest.Config{Records: testRecords(20), PageSize: 4})
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	c := NewCachingClientDir(&buf, t.TempDir())
+	req := Request{
+		Endpoint:    ts.URL,
+		Verb:        "ListRecords",
+		Prefix:      "oai_dc",
+		From:        time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		Until:       time.Date(2000, 1, 31, 0, 0, 0, 0, time.UTC),
+		Granularity: GranularityDay,
+	}
+	if err := c.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "<record>"); n != 20 {
+		t.Errorf("got %d records, want 20", n)
+	}
+	requests := ts.Requests()
+	buf.Reset()
+	if err := c.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "<record>"); n != 20 {
+		t.Errorf("got %d records from cache, want 20", n)
+	}
+	if ts.Requests() != requests {
+		t.Errorf("got %d requests, want %d, cache not used", ts.Requests(), requests)
+	}
+}
+
+func TestCachingClientIdentifiers(t *testing.T) {
+	records := testRecords(10)
+	for i := range records {
+		if i%2 == 0 {
+			records[i].Sets = []string{"even"}
+		}
+	}
+	records[4].Deleted = true
+	ts := oaitest.NewServer(oaitest.Config{Records: records, Sets: []oaitest.Set{{Spec: "even"}}, PageSize: 2})
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	dir := t.TempDir()
+	c := NewCachingClientDir(&buf, dir)
+	c.Format = FormatTSV
+	req := Request{
+		Endpoint:    ts.URL,
+		Verb:        "ListIdentifiers",
+		Prefix:      "oai_dc",
+		Set:         "even",
+		From:        time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		Until:       time.Date(2000, 1, 31, 0, 0, 0, 0, time.UTC),
+		Granularity: GranularityDay,
+	}
+	if err := c.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("got %d lines, want 5: %s", len(lines), buf.String())
+	}
+	if lines[2] != "r4\t2000-01-05\tdeleted" {
+		t.Errorf("got %q, want deleted r4", lines[2])
+	}
+	shardDir, err := c.RequestCacheDir(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(shardDir, filepath.Join("ListIdentifiers", "oai_dc", "set-even")) {
+		t.Errorf("RequestCacheDir() got %s", shardDir)
+	}
+}
+
+func TestMigrateCache(t *testing.T) {
+	// 2000-01-01 is a Saturday, so the first two weekly shards hold records
+	// of set a only, the third one other records, too
+	records := testRecords(14)
+	for i := range records {
+		if i < 8 || i%2 == 0 {
+			records[i].Sets = []string{"a"}
+		}
+	}
+	ts := oaitest.NewServer(oaitest.Config{Records: records, Sets: []oaitest.Set{{Spec: "a"}}})
+	defer ts.Close()
+
+	c := NewCachingClientDir(ioutil.Discard, t.TempDir())
+	req := Request{
+		Endpoint:    ts.URL,
+		Verb:        "ListRecords",
+		Prefix:      "oai_dc",
+		From:        time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		Until:       time.Date(2000, 1, 13, 0, 0, 0, 0, time.UTC),
+		Granularity: GranularityDay,
+	}
+	if err := c.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	legacy, _ := shardPrefix(req)
+	first := path.Join(legacy, "2000-01-02-2000-01-08.xml.gz")
+	fi, err := os.Stat(FileStore{Dir: c.CacheDir}.path(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Set = "a"
+	c.Store = &FileStore{Dir: c.CacheDir}
+	n, err := c.MigrateCache(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("MigrateCache() moved %d shards, want 2", n)
+	}
+	prefix, _ := shardPrefix(req)
+	shards, err := ListShards(c.store(), prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shards) != 2 || shards[0].Info == nil || shards[1].Info == nil {
+		t.Errorf("got %+v in set directory, want 2 shards with manifest entries", shards)
+	}
+	// shards of a FileStore are renamed, not copied
+	key := path.Join(prefix, path.Base(first))
+	if gi, err := os.Stat(FileStore{Dir: c.CacheDir}.path(key)); err != nil || !gi.ModTime().Equal(fi.ModTime()) {
+		t.Errorf("moved shard got %v, want modification time kept", err)
+	}
+	m, err := ReadManifest(c.store(), legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.find(path.Base(first)); ok || len(m.Shards) != 1 {
+		t.Errorf("legacy manifest got %+v, want moved shards removed", m.Shards)
+	}
+	if err := c.RepairShard(context.Background(), key); err != nil {
+		t.Errorf("RepairShard() of migrated shard got %v", err)
+	}
+	c.Store = &KVStore{}
+	if _, err := c.RequestCacheDir(req); err != ErrNoCacheDir {
+		t.Errorf("RequestCacheDir() with KVStore got %v, want %v", err, ErrNoCacheDir)
+	}
+}
+
+func TestWriterClientCheckpoint(t *testing.T) {
+	var requests int32
+	h := oaitest.NewHandler(oaitest.Config{Records: testRecords(10), PageSize: 2})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 3 {
+			fmt.Fprint(w, "<OAI-PMH><ListRecords><rec")
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	fn := filepath.Join(t.TempDir(), "shard.xml.gz")
+	req := Request{Endpoint: ts.URL, Verb: "ListRecords", Prefix: "oai_dc"}
+	for i, want := range []int32{3, 6} {
+		file := CreateResumableFile(fn)
+		client := WriterClient{client: NewClientDoer(http.DefaultClient), w: file, Checkpoint: fn + checkpointSuffix}
+		err := client.Do(req)
+		if i == 0 {
+			if err == nil {
+				t.Fatal("Do() got nil, want error")
+			}
+			file.Abort()
+		} else {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := file.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := atomic.LoadInt32(&requests); n != want {
+			t.Errorf("got %d requests, want %d", n, want)
+		}
+	}
+	var n int
+	if err := eachRecord(FileStore{Dir: filepath.Dir(fn)}, []string{filepath.Base(fn)}, func(_ position, _ Record) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 10 {
+		t.Errorf("got %d records, want 10", n)
+	}
+	for _, suffix := range []string{partSuffix, checkpointSuffix} {
+		if _, err := os.Stat(fn + suffix); !os.IsNotExist(err) {
+			t.Errorf("%s left behind", suffix)
+		}
+	}
+}
+
+func TestWriterClientVerbatim(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<?xml version="1.0" encoding="ISO-8859-1"?>`+
+			`<OAI-PMH xmlns="http://www.openarchives.org/OAI/2.0/"><ListRecords>`+
+			`<record><header><identifier>a</identifier><datestamp>2000-01-01</datestamp></header>`+
+			`<metadata><x:dc xmlns:x="urn:x">M`+"\xfc"+`ller</x:dc></metadata>`+
+			`<about><provenance>p</provenance></about></record></ListRecords></OAI-PMH>`)
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	client := WriterClient{client: NewClientDoer(http.DefaultClient), w: &buf}
+	if err := client.Do(Request{Endpoint: ts.URL, Verb: "ListRecords", Prefix: "oai_dc"}); err != nil {
+		t.Fatal(err)
+	}
+	want := `<OAI-PMH xmlns="http://www.openarchives.org/OAI/2.0/"><ListRecords>` +
+		`<record><header><identifier>a</identifier><datestamp>2000-01-01</datestamp></header>` +
+		`<metadata><x:dc xmlns:x="urn:x">Müller</x:dc></metadata>` +
+		`<about><provenance>p</provenance></about></record></ListRecords></OAI-PMH>`
+	if buf.String() != want {
+		t.Errorf("got %s, want %s", buf.String(), want)
+	}
+}
+
+func TestWriterClientRecoveryLatin1(t *testing.T) {
+	record := func(id, date string) string {
+		return `<record><header><identifier>` + id + `</identifier><datestamp>` + date + `</datestamp></header>` +
+			`<metadata><dc>M` + "\xfc\xfc" + `ller</dc></metadata></record>`
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<?xml version="1.0" encoding="ISO-8859-1"?><OAI-PMH><request verb="ListRecords">x</request>`)
+		switch {
+		case r.URL.Query().Get("resumptionToken") != "":
+			fmt.Fprint(w, `<error code="badResumptionToken">expired</error>`)
+		case r.URL.Query().Get("from") != "":
+			fmt.Fprint(w, `<ListRecords>`+record("b", "2000-01-02")+record("c", "2000-01-03")+`</ListRecords>`)
+		default:
+			fmt.Fprint(w, `<ListRecords>`+record("a", "2000-01-01")+record("b", "2000-01-02")+
+				`<resumptionToken>t</resumptionToken></ListRecords>`)
+		}
+		fmt.Fprint(w, `</OAI-PMH>`)
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	client := WriterClient{client: NewClientDoer(http.DefaultClient), w: &buf}
+	if err := client.Do(Request{Endpoint: ts.URL, Verb: "ListRecords", Prefix: "oai_dc"}); err != nil {
+		t.Fatal(err)
+	}
+	record = func(id, date string) string {
+		return `<record><header><identifier>` + id + `</identifier><datestamp>` + date + `</datestamp></header>` +
+			`<metadata><dc>Müüller</dc></metadata></record>`
+	}
+	want := `<OAI-PMH><request verb="ListRecords">x</request><ListRecords>` +
+		record("a", "2000-01-01") + record("b", "2000-01-02") +
+		`<resumptionToken>t</resumptionToken></ListRecords></OAI-PMH>` +
+		`<OAI-PMH><request verb="ListRecords">x</request><ListRecords>` +
+		record("c", "2000-01-03") + `</ListRecords></OAI-PMH>`
+	if buf.String() != want {
+		t.Errorf("got %s, want %s", buf.String(), want)
+	}
+}
+
+func TestGetRecord(t *testing.T) {
+	ts := oaitest.NewServer(oaitest.Config{Records: testRecords(3)})
+	defer ts.Close()
+
+	client := NewClientDoer(http.DefaultClient)
+	rec, page, err := client.GetRecord(Request{Endpoint: ts.URL, Identifier: "r1", Prefix: "oai_dc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Header.Identifier != "r1" || !strings.Contains(rec.Metadata.Verbatim, "<dc:title>r1</dc:title>") {
+		t.Errorf("GetRecord() got %+v", rec)
+	}
+	if !bytes.Contains(page, []byte("<GetRecord>")) || bytes.Contains(page, []byte("<?xml")) {
+		t.Errorf("GetRecord() page got %s", page)
+	}
+	_, _, err = client.GetRecord(Request{Endpoint: ts.URL, Identifier: "r9", Prefix: "oai_dc"})
+	if e, ok := err.(OAIError); !ok || e.Code != "idDoesNotExist" {
+		t.Errorf("GetRecord() got %v, want idDoesNotExist", err)
+	}
+}
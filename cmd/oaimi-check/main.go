@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/miku/oaimi"
+	"github.com/mitchellh/go-homedir"
+)
+
+// status returns "deleted" for deleted entries and an empty string otherwise.
+func status(e oaimi.Entry) string {
+	if e.Deleted {
+		return "deleted"
+	}
+	return ""
+}
+
+func main() {
+	home, err := homedir.Dir()
+	if err != nil {
+		home = "."
+	}
+
+	cacheDir := flag.String("cache", filepath.Join(home, oaimi.DefaultCacheDir), "oaimi cache dir")
+	storeLocation := flag.String("store", "", "shared cache store to use instead of the cache dir: kv:<file> or s3://host/bucket/prefix")
+	set := flag.String("set", "", "OAI set")
+	prefix := flag.String("prefix", "oai_dc", "OAI metadataPrefix")
+	from := flag.String("from", "", "OAI from, YYYY-MM-DD or YYYY-MM-DDThh:mm:ssZ")
+	until := flag.String("until", time.Now().Format("2006-01-02"), "OAI until, YYYY-MM-DD or YYYY-MM-DDThh:mm:ssZ")
+	asJSON := flag.Bool("json", false, "write the report as a single JSON object")
+	sanitize := flag.Bool("sanitize", false, "repair illegal XML characters, invalid UTF-8 and legacy encodings in responses")
+	verbose := flag.Bool("verbose", false, "more output")
+	showVersion := flag.Bool("v", false, "prints current program version")
+
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(oaimi.Version)
+		os.Exit(0)
+	}
+
+	if flag.NArg() == 0 {
+		log.Fatal("endpoint URL required")
+	}
+
+	endpoint := flag.Arg(0)
+	if !strings.HasPrefix(endpoint, "http") {
+		endpoint = "http://" + endpoint
+	}
+
+	oaimi.Verbose = *verbose
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	client := oaimi.NewCachingClientDir(ioutil.Discard, *cacheDir)
+	if *storeLocation != "" {
+		if client.Store, err = oaimi.OpenCacheStore(*storeLocation); err != nil {
+			log.Fatal(err)
+		}
+	}
+	client.Sanitize = *sanitize
+
+	req := oaimi.Request{Endpoint: endpoint, Prefix: *prefix, Set: *set}
+	if *from != "" {
+		if req.From, err = oaimi.ParseDatestamp(*from); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *until != "" {
+		if req.Until, err = oaimi.ParseUntil(*until); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	r, err := client.ReconcileContext(ctx, req)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *asJSON {
+		b, err := json.Marshal(r)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(b))
+	} else {
+		w := bufio.NewWriter(os.Stdout)
+		for _, e := range r.Missing {
+			fmt.Fprintf(w, "missing\t%s\t%s\t%s\n", e.Identifier, e.Datestamp, status(e))
+		}
+		for _, e := range r.Extra {
+			fmt.Fprintf(w, "extra\t%s\t%s\t%s\n", e.Identifier, e.Datestamp, status(e))
+		}
+		for _, m := range r.Mismatched {
+			fmt.Fprintf(w, "datestamp\t%s\t%s\t%s\n", m.Identifier, m.Identifiers, m.Records)
+		}
+		if err := w.Flush(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *verbose {
+		log.Printf("%d identifiers, %d records, %d missing, %d extra, %d mismatched",
+			r.Identifiers, r.Records, len(r.Missing), len(r.Extra), len(r.Mismatched))
+	}
+	if !r.OK() {
+		os.Exit(2)
+	}
+}
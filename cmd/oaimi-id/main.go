@@ -2,25 +2,42 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/miku/oaimi"
 )
 
 var Verbose bool
+var Validate bool
 
-func worker(queue, out chan string, timeout time.Duration, wg *sync.WaitGroup) {
+// inspect gathers repository information or, in validator mode, a scorecard.
+func inspect(ctx context.Context, endpoint string) (interface{}, error) {
+	if Validate {
+		return oaimi.ValidateEndpointContext(ctx, endpoint)
+	}
+	return oaimi.AboutEndpointContext(ctx, endpoint)
+}
+
+func worker(ctx context.Context, queue, out chan string, timeout time.Duration, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for endpoint := range queue {
-		ri, err := oaimi.AboutEndpoint(endpoint, timeout)
+		if ctx.Err() != nil {
+			continue
+		}
+		ectx, cancel := context.WithTimeout(ctx, timeout)
+		ri, err := inspect(ectx, endpoint)
+		cancel()
 		if err != nil {
 			if Verbose {
 				log.Printf("failed %s: %s", endpoint, err)
@@ -49,6 +66,7 @@ func main() {
 	timeout := flag.Duration("timeout", 30*time.Minute, "deadline for requests")
 	workers := flag.Int("w", 8, "requests in parallel")
 	verbose := flag.Bool("verbose", false, "be verbose")
+	validate := flag.Bool("validate", false, "run protocol checks and write a scorecard per endpoint")
 	showVersion := flag.Bool("v", false, "prints current program version")
 
 	flag.Parse()
@@ -59,6 +77,7 @@ func main() {
 	}
 
 	Verbose = *verbose
+	Validate = *validate
 	oaimi.Verbose = *verbose
 
 	var reader io.Reader
@@ -79,15 +98,18 @@ func main() {
 
 	var wg sync.WaitGroup
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	go writer(out, done)
 
 	for i := 0; i < *workers; i++ {
 		wg.Add(1)
-		go worker(queue, out, *timeout, &wg)
+		go worker(ctx, queue, out, *timeout, &wg)
 	}
 
 	rdr := bufio.NewReader(reader)
-	for {
+	for ctx.Err() == nil {
 		line, err := rdr.ReadString('\n')
 		if err == io.EOF {
 			break
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/miku/oaimi"
+	"github.com/mitchellh/go-homedir"
+)
+
+func main() {
+
+	home, err := homedir.Dir()
+	if err != nil {
+		panic(err)
+	}
+
+	addr := flag.String("addr", "localhost:8000", "address to listen on")
+	cacheDir := flag.String("cache", filepath.Join(home, oaimi.DefaultCacheDir), "where the harvested responses are cached")
+	storeLocation := flag.String("store", "", "shared cache store to use instead of the cache dir: kv:<file> or s3://host/bucket/prefix")
+	pageSize := flag.Int("size", oaimi.DefaultPageSize, "number of items per list response")
+	adminEmail := flag.String("email", "", "admin email to report in Identify")
+	offline := flag.Bool("offline", false, "do not ask the upstream endpoint for name, sets and formats")
+	timeout := flag.Duration("timeout", 1*time.Minute, "deadline for upstream requests")
+	verbose := flag.Bool("verbose", false, "be verbose")
+	showVersion := flag.Bool("v", false, "prints current program version")
+
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(oaimi.Version)
+		os.Exit(0)
+	}
+
+	if flag.NArg() == 0 {
+		log.Fatal("endpoint required")
+	}
+
+	oaimi.Verbose = *verbose
+
+	endpoint := flag.Arg(0)
+	if !strings.HasPrefix(endpoint, "http") {
+		endpoint = "http://" + endpoint
+	}
+
+	var store oaimi.CacheStore = oaimi.FileStore{Dir: *cacheDir}
+	if *storeLocation != "" {
+		if store, err = oaimi.OpenCacheStore(*storeLocation); err != nil {
+			log.Fatal(err)
+		}
+	}
+	provider, err := oaimi.NewStoreProvider(store, endpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	provider.PageSize = *pageSize
+
+	if !*offline {
+		info, err := oaimi.AboutEndpoint(endpoint, *timeout)
+		if err != nil {
+			log.Printf("using defaults, upstream not available: %s", err)
+		} else {
+			mergeInfo(provider, info)
+		}
+	}
+	if *adminEmail != "" {
+		provider.Identify.AdminEmail = *adminEmail
+	}
+
+	if *verbose {
+		log.Printf("serving %s from %s on %s", endpoint, *cacheDir, *addr)
+	}
+	log.Fatal(http.ListenAndServe(*addr, provider))
+}
+
+// mergeInfo copies repository name, admin email, set names and format schemas
+// from the upstream repository, as far as they apply to the cached data.
+func mergeInfo(p *oaimi.Provider, info *oaimi.RepositoryInfo) {
+	if info.About.Name != "" {
+		p.Identify.Name = info.About.Name
+	}
+	if info.About.AdminEmail != "" {
+		p.Identify.AdminEmail = info.About.AdminEmail
+	}
+	names := make(map[string]string)
+	for _, s := range info.Sets.Sets {
+		names[s.Spec] = s.Name
+	}
+	for i, s := range p.Sets.Sets {
+		if name, ok := names[s.Spec]; ok && name != "" {
+			p.Sets.Sets[i].Name = name
+		}
+	}
+	for i, f := range p.Formats.Formats {
+		for _, g := range info.Formats.Formats {
+			if f.Prefix == g.Prefix {
+				p.Formats.Formats[i].Schema = g.Schema
+				p.Formats.Formats[i].Namespace = g.Namespace
+			}
+		}
+	}
+}
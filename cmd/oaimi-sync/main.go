@@ -2,15 +2,19 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/miku/oaimi"
 	"github.com/mitchellh/go-homedir"
@@ -18,19 +22,30 @@ import (
 
 var Verbose bool
 var CacheDir string
+var Store oaimi.CacheStore
+var Adaptive bool
+var Grace time.Duration
+var Sanitize bool
 
 type work struct {
 	endpoint string
 	format   string
 }
 
-func worker(queue chan work, wg *sync.WaitGroup) {
+func worker(ctx context.Context, queue chan work, wg *sync.WaitGroup) {
 	defer wg.Done()
 	client := oaimi.NewCachingClient(ioutil.Discard)
 	client.CacheDir = CacheDir
+	client.Store = Store
+	client.Adaptive = Adaptive
+	client.Grace = Grace
+	client.Sanitize = Sanitize
 	for w := range queue {
+		if ctx.Err() != nil {
+			continue
+		}
 		req := oaimi.Request{Verb: "ListRecords", Endpoint: w.endpoint, Prefix: w.format}
-		err := client.Do(req)
+		err := client.DoContext(ctx, req)
 		if err != nil {
 			if Verbose {
 				log.Printf("failed %s: %s", w.endpoint, err)
@@ -53,6 +68,12 @@ func main() {
 	workers := flag.Int("w", 8, "requests in parallel")
 	verbose := flag.Bool("verbose", false, "be verbose")
 	cacheDir := flag.String("cache", filepath.Join(home, oaimi.DefaultCacheDir), "where to cache responses")
+	storeLocation := flag.String("store", "", "shared cache store to use instead of the cache dir: kv:<file> or s3://host/bucket/prefix")
+	grace := flag.Duration("grace", oaimi.DefaultGrace, "harvest windows again, that ended less than this duration before the last harvest")
+	adaptive := flag.Bool("adaptive", false, "choose window sizes by record density instead of weekly windows")
+	rate := flag.Float64("rate", 0, "requests per second per host, 0 means no limit")
+	perHost := flag.Int("per-host", 2, "requests in parallel per host, 0 means no limit")
+	sanitize := flag.Bool("sanitize", false, "repair illegal XML characters, invalid UTF-8 and legacy encodings in responses")
 	showVersion := flag.Bool("v", false, "prints current program version")
 
 	flag.Parse()
@@ -63,8 +84,18 @@ func main() {
 	}
 
 	CacheDir = *cacheDir
+	if *storeLocation != "" {
+		if Store, err = oaimi.OpenCacheStore(*storeLocation); err != nil {
+			log.Fatal(err)
+		}
+	}
+	Adaptive = *adaptive
+	Grace = *grace
+	Sanitize = *sanitize
 	Verbose = *verbose
 	oaimi.Verbose = *verbose
+	oaimi.DefaultHostLimiter.Rate = *rate
+	oaimi.DefaultHostLimiter.Concurrency = *perHost
 
 	var reader io.Reader
 
@@ -78,16 +109,20 @@ func main() {
 		}
 	}
 
+	// Stop all workers on interrupt, already completed windows stay cached.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	queue := make(chan work)
 	var wg sync.WaitGroup
 
 	for i := 0; i < *workers; i++ {
 		wg.Add(1)
-		go worker(queue, &wg)
+		go worker(ctx, queue, &wg)
 	}
 
 	rdr := bufio.NewReader(reader)
-	for {
+	for ctx.Err() == nil {
 		line, err := rdr.ReadString('\n')
 		if err == io.EOF {
 			break
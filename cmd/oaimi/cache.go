@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miku/oaimi"
+	"github.com/mitchellh/go-homedir"
+)
+
+// cacheCommand implements `oaimi cache`, which inspects and maintains the
+// cache.
+func cacheCommand(ctx context.Context, args []string) error {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: oaimi cache ls|verify|gc [flags] [<endpoint>]")
+	}
+	if len(args) == 0 {
+		usage()
+		return fmt.Errorf("cache subcommand required")
+	}
+	switch args[0] {
+	case "ls":
+		return listCache(args[1:])
+	case "verify":
+		return verifyCache(ctx, args[1:])
+	case "gc":
+		return collectGarbage(args[1:])
+	}
+	usage()
+	return fmt.Errorf("unknown cache subcommand: %s", args[0])
+}
+
+// cacheFlags registers the flags, that select the cache, and returns a
+// function, that opens it.
+func cacheFlags(fs *flag.FlagSet) func() (oaimi.CacheStore, error) {
+	home, err := homedir.Dir()
+	if err != nil {
+		home = "."
+	}
+	cacheDir := fs.String("cache", filepath.Join(home, oaimi.DefaultCacheDir), "oaimi cache dir")
+	storeLocation := fs.String("store", "", "shared cache store to use instead of the cache dir: kv:<file> or s3://host/bucket/prefix")
+	return func() (oaimi.CacheStore, error) {
+		if *storeLocation != "" {
+			return oaimi.OpenCacheStore(*storeLocation)
+		}
+		return oaimi.FileStore{Dir: *cacheDir}, nil
+	}
+}
+
+// endpointPrefix returns the store prefix of the endpoint argument, if any.
+func endpointPrefix(positional []string) (string, error) {
+	if len(positional) == 0 {
+		return "", nil
+	}
+	return oaimi.EndpointPrefix(positional[0])
+}
+
+// listCache implements `oaimi cache ls`, which lists cached shards together
+// with their manifest entries, as TSV or JSON lines.
+func listCache(args []string) error {
+	fs := flag.NewFlagSet("cache ls", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: oaimi cache ls [flags] [<endpoint>]")
+		fs.PrintDefaults()
+	}
+	openStore := cacheFlags(fs)
+	asJSON := fs.Bool("json", false, "write manifest entries as JSON lines")
+
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	prefix, err := endpointPrefix(positional)
+	if err != nil {
+		return err
+	}
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+	shards, err := oaimi.ListShards(store, prefix)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	if *asJSON {
+		enc := json.NewEncoder(w)
+		for _, shard := range shards {
+			if err := enc.Encode(shard); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, shard := range shards {
+		si := shard.Info
+		if si == nil {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\t-\t-\t-\n", shard.Key)
+			continue
+		}
+		result := "ok"
+		switch {
+		case !si.OK():
+			result = strings.Join(strings.Fields(si.Error), " ")
+		case si.NoRecordsMatch:
+			result = "noRecordsMatch"
+		}
+		fetched := "-"
+		if !si.Fetched.IsZero() {
+			fetched = si.Fetched.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%s\n",
+			shard.Key, fetched, si.Version, si.Records, si.Pages, si.Size, si.Status, result)
+	}
+	return nil
+}
+
+// verifyCache implements `oaimi cache verify`, which checks every shard and
+// writes key, reason and action of each damaged one as TSV. Exits with status
+// 2, if damaged shards remain.
+func verifyCache(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("cache verify", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: oaimi cache verify [flags] [<endpoint>]")
+		fs.PrintDefaults()
+	}
+	openStore := cacheFlags(fs)
+	remove := fs.Bool("delete", false, "delete damaged shards, they are harvested again on the next run")
+	repair := fs.Bool("repair", false, "harvest damaged shards again, with the request recorded in the manifest")
+	sanitize := fs.Bool("sanitize", false, "repair illegal XML characters, invalid UTF-8 and legacy encodings in responses, with -repair")
+	verbose := fs.Bool("verbose", false, "more output")
+
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	prefix, err := endpointPrefix(positional)
+	if err != nil {
+		return err
+	}
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+	oaimi.Verbose = *verbose
+	client := oaimi.NewCachingClient(ioutil.Discard)
+	client.Store = store
+	client.Sanitize = *sanitize
+
+	shards, err := oaimi.ListShards(store, prefix)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	var damaged int
+	for _, shard := range shards {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := oaimi.VerifyShard(store, shard)
+		serr, ok := err.(*oaimi.ShardError)
+		if !ok {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		action := "-"
+		switch {
+		case *repair:
+			action = "repaired"
+			if err := client.RepairShard(ctx, shard.Key); err != nil {
+				action = fmt.Sprintf("repair failed: %s", err)
+				damaged++
+			}
+		case *remove:
+			action = "deleted"
+			if err := oaimi.DeleteShard(store, shard.Key); err != nil {
+				return err
+			}
+		default:
+			damaged++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", shard.Key, serr.Reason, action)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if *verbose {
+		log.Printf("verified %d shard(s)", len(shards))
+	}
+	if damaged > 0 {
+		log.Printf("%d damaged shard(s)", damaged)
+		os.Exit(2)
+	}
+	return nil
+}
+
+// parseSize parses a number of bytes with an optional K, M, G or T suffix.
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	var unit int64 = 1
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(s, suffix) {
+			s, unit = strings.TrimSuffix(s, suffix), 1<<(10*uint(i+1))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return n * unit, nil
+}
+
+// collectGarbage implements `oaimi cache gc`, which removes shards by size,
+// age and recency, as well as leftovers of interrupted writes, and writes
+// key, size and reason of each removed file as TSV.
+func collectGarbage(args []string) error {
+	fs := flag.NewFlagSet("cache gc", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: oaimi cache gc [flags] [<endpoint>]")
+		fs.PrintDefaults()
+	}
+	openStore := cacheFlags(fs)
+	maxSize := fs.String("max-size", "", "remove the least recently harvested shards, until all shards fit into this size, e.g. 20G")
+	maxAge := fs.Duration("max-age", 0, "remove shards, partial files and checkpoints written longer ago, e.g. 2160h")
+	keepLatest := fs.Int("keep-latest", 0, "keep only the N most recently harvested requests (verb, format and set) of each endpoint")
+	stale := fs.Duration("stale", 24*time.Hour, "remove temporary files and leftovers of interrupted writes older than this, 0 keeps them")
+	dryRun := fs.Bool("n", false, "only show, what would be removed")
+	verbose := fs.Bool("verbose", false, "more output")
+
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	prefix, err := endpointPrefix(positional)
+	if err != nil {
+		return err
+	}
+	policy := oaimi.GCPolicy{MaxAge: *maxAge, KeepLatest: *keepLatest, Stale: *stale, DryRun: *dryRun}
+	if *maxSize != "" {
+		if policy.MaxSize, err = parseSize(*maxSize); err != nil {
+			return err
+		}
+	}
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+	removals, err := oaimi.CollectGarbage(store, prefix, policy)
+	if err != nil {
+		return err
+	}
+	// temporary files of running processes are recent, so a zero
+	// duration must not be used to clean up
+	if *stale > 0 {
+		temp, err := oaimi.CleanTempFiles(*stale, *dryRun)
+		if err != nil {
+			return err
+		}
+		removals = append(removals, temp...)
+	}
+	if kv, ok := store.(*oaimi.KVStore); ok && len(removals) > 0 && !*dryRun {
+		// space of removed values is only reclaimed by compaction
+		if err := kv.Compact(); err != nil {
+			return err
+		}
+	}
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	var total int64
+	for _, r := range removals {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", r.Key, r.Size, r.Reason)
+		total += r.Size
+	}
+	if *verbose {
+		verb := "removed"
+		if *dryRun {
+			verb = "would remove"
+		}
+		log.Printf("%s %d file(s), %d bytes", verb, len(removals), total)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/miku/oaimi"
+)
+
+// parseInterspersed parses flags, that may follow positional arguments, like
+// in `oaimi get <endpoint> <identifier> -prefix marcxml`.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// getRecords implements `oaimi get`, which fetches single records by
+// identifier. Without identifier, identifiers are read from stdin, one per
+// line, and fetched in parallel.
+func getRecords(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: oaimi get [flags] <endpoint> [<identifier>]")
+		fs.PrintDefaults()
+	}
+	prefix := fs.String("prefix", "oai_dc", "OAI metadataPrefix")
+	format := fs.String("format", "raw", "output format: raw, json or metadata")
+	root := fs.String("root", "", "name of artificial root element tag to use for raw output")
+	workers := fs.Int("w", 8, "requests in parallel, when reading identifiers from stdin")
+	sanitize := fs.Bool("sanitize", false, "repair illegal XML characters, invalid UTF-8 and legacy encodings in responses")
+	verbose := fs.Bool("verbose", false, "more output")
+
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		fs.Usage()
+		return fmt.Errorf("endpoint URL required")
+	}
+	switch *format {
+	case "raw", "json", "metadata":
+	default:
+		return oaimi.ErrBadFormat
+	}
+	oaimi.Verbose = *verbose
+
+	endpoint := positional[0]
+	if !strings.HasPrefix(endpoint, "http") {
+		endpoint = "http://" + endpoint
+	}
+	client := oaimi.NewClient()
+	client.Sanitize = *sanitize
+
+	var mu sync.Mutex
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	if *format == "raw" && *root != "" {
+		fmt.Fprintf(w, "<%s>", *root)
+		defer fmt.Fprintf(w, "</%s>", *root)
+	}
+
+	get := func(identifier string) error {
+		req := oaimi.Request{Endpoint: endpoint, Verb: "GetRecord", Identifier: identifier, Prefix: *prefix}
+		rec, page, err := client.GetRecordContext(ctx, req)
+		if err != nil {
+			return fmt.Errorf("%s: %s", identifier, err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch *format {
+		case "json":
+			enc := json.NewEncoder(w)
+			enc.SetEscapeHTML(false)
+			return enc.Encode(oaimi.NewJSONRecord(req, rec))
+		case "metadata":
+			_, err = fmt.Fprintln(w, strings.TrimSpace(rec.Metadata.Verbatim))
+		default:
+			_, err = w.Write(page)
+		}
+		return err
+	}
+
+	if len(positional) > 1 {
+		for _, identifier := range positional[1:] {
+			if err := get(identifier); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	var failed int
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for identifier := range queue {
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := get(identifier); err != nil {
+					log.Println(err)
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	rdr := bufio.NewReader(os.Stdin)
+	var readErr error
+	for ctx.Err() == nil {
+		line, err := rdr.ReadString('\n')
+		if identifier := strings.TrimSpace(line); identifier != "" {
+			queue <- identifier
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			readErr = err
+			break
+		}
+	}
+	close(queue)
+	wg.Wait()
+	if readErr != nil {
+		return readErr
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d records failed", failed)
+	}
+	return ctx.Err()
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/miku/oaimi"
@@ -15,6 +18,23 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "get" {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := getRecords(ctx, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "cache" {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := cacheCommand(ctx, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	var err error
 	home, err := homedir.Dir()
 	if err != nil {
@@ -22,15 +42,24 @@ func main() {
 	}
 
 	cacheDir := flag.String("cache", filepath.Join(home, oaimi.DefaultCacheDir), "oaimi cache dir")
+	storeLocation := flag.String("store", "", "shared cache store to use instead of the cache dir: kv:<file> or s3://host/bucket/prefix")
 	showRepoInfo := flag.Bool("id", false, "show repository info")
 	set := flag.String("set", "", "OAI set")
 	prefix := flag.String("prefix", "oai_dc", "OAI metadataPrefix")
-	from := flag.String("from", "", "OAI from")
-	until := flag.String("until", time.Now().Format("2006-01-02"), "OAI until")
+	from := flag.String("from", "", "OAI from, YYYY-MM-DD or YYYY-MM-DDThh:mm:ssZ")
+	until := flag.String("until", time.Now().Format("2006-01-02"), "OAI until, YYYY-MM-DD or YYYY-MM-DDThh:mm:ssZ")
 	root := flag.String("root", "", "name of artificial root element tag to use")
 	showVersion := flag.Bool("v", false, "prints current program version")
 	verbose := flag.Bool("verbose", false, "more output")
 	dirname := flag.Bool("dirname", false, "show shard directory for request")
+	grace := flag.Duration("grace", oaimi.DefaultGrace, "harvest windows again, that ended less than this duration before the last harvest")
+	format := flag.String("format", oaimi.FormatXML, "output format: xml, jsonl or tsv")
+	identifiers := flag.Bool("identifiers", false, "list identifier, datestamp and status of records as TSV, via ListIdentifiers")
+	snapshot := flag.Bool("snapshot", false, "only write the latest version of each record, without deleted records")
+	adaptive := flag.Bool("adaptive", false, "choose window sizes by record density instead of weekly windows")
+	migrate := flag.Bool("migrate", false, "move shards of -set from the pre-set cache layout into the set directory")
+	about := flag.String("about", "", "only write records with an about container containing this text, e.g. a rights statement URL")
+	sanitize := flag.Bool("sanitize", false, "repair illegal XML characters, invalid UTF-8 and legacy encodings in responses")
 
 	flag.Parse()
 
@@ -52,8 +81,14 @@ func main() {
 		log.Fatal("cache dir must be set")
 	}
 
+	// Stop harvesting on interrupt, already completed windows stay cached.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	if *showRepoInfo {
-		ri, err := oaimi.AboutEndpoint(endpoint, 10*time.Minute)
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+		defer cancel()
+		ri, err := oaimi.AboutEndpointContext(ctx, endpoint)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -68,10 +103,23 @@ func main() {
 	oaimi.Verbose = *verbose
 
 	client := oaimi.NewCachingClientDir(os.Stdout, *cacheDir)
+	if *storeLocation != "" {
+		if client.Store, err = oaimi.OpenCacheStore(*storeLocation); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	if *root != "" {
 		client.RootTag = *root
 	}
+	client.Adaptive = *adaptive
+	client.Format = *format
+	client.Grace = *grace
+	client.Sanitize = *sanitize
+	client.About = *about
+	client.Report = func(r oaimi.Repairs) {
+		log.Printf("repaired %s", r)
+	}
 
 	req := oaimi.Request{
 		Endpoint: endpoint,
@@ -79,24 +127,28 @@ func main() {
 		Prefix:   *prefix,
 	}
 
+	if *identifiers {
+		req.Verb = "ListIdentifiers"
+		client.Format = oaimi.FormatTSV
+	}
+
 	if *set != "" {
 		req.Set = *set
 	}
 
 	if *from != "" {
-		if req.From, err = time.Parse("2006-01-02", *from); err != nil {
+		if req.From, err = oaimi.ParseDatestamp(*from); err != nil {
 			log.Fatal(err)
 		}
 	}
 
 	if *until != "" {
-		if req.Until, err = time.Parse("2006-01-02", *until); err != nil {
+		if req.Until, err = oaimi.ParseUntil(*until); err != nil {
 			log.Fatal(err)
 		}
 	}
 
 	if *dirname {
-		req.UseDefaults()
 		dir, err := client.RequestCacheDir(req)
 		if err != nil {
 			log.Fatal(err)
@@ -105,7 +157,26 @@ func main() {
 		os.Exit(0)
 	}
 
-	if err := client.Do(req); err != nil {
+	if *migrate {
+		if req.Set == "" {
+			log.Fatal("-migrate requires -set")
+		}
+		n, err := client.MigrateCache(req)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *verbose {
+			log.Printf("moved %d shard(s)", n)
+		}
+		os.Exit(0)
+	}
+
+	if *snapshot {
+		err = client.SnapshotContext(ctx, req)
+	} else {
+		err = client.DoContext(ctx, req)
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
 }
@@ -13,6 +13,9 @@ import (
 
 const CompressThreshold = 1024
 
+// partSuffix is appended to the name of the partial file of a resumable file.
+const partSuffix = ".part"
+
 var (
 	ErrFileNotWriteable = errors.New("not opened for writing")
 	ErrFileNotReadable  = errors.New("not opened for reading")
@@ -29,6 +32,14 @@ func CreateMaybeCompressedFile(filename string) *MaybeCompressedFile {
 	return &MaybeCompressedFile{w: &compresswriter{filename: filename}}
 }
 
+// CreateResumableFile is like CreateMaybeCompressedFile, but the data is
+// written to a partial file next to the target. The partial file is kept on
+// Abort, so an interrupted write can continue later, after truncating the
+// partial file to a known good size.
+func CreateResumableFile(filename string) *MaybeCompressedFile {
+	return &MaybeCompressedFile{w: &compresswriter{filename: filename, partial: true}}
+}
+
 // OpenMaybeCompressedFile returns a file, that may be transparently
 // decompressed on the fly.
 func OpenMaybeCompressedFile(filename string) (*MaybeCompressedFile, error) {
@@ -76,6 +87,32 @@ func (f *MaybeCompressedFile) Write(p []byte) (n int, err error) {
 	return f.w.Write(p)
 }
 
+// Sync persists the data written so far and returns its size.
+func (f *MaybeCompressedFile) Sync() (int64, error) {
+	if f.w == nil {
+		return 0, ErrFileNotWriteable
+	}
+	return f.w.Sync()
+}
+
+// Truncate discards everything written after size.
+func (f *MaybeCompressedFile) Truncate(size int64) error {
+	if f.w == nil {
+		return ErrFileNotWriteable
+	}
+	return f.w.Truncate(size)
+}
+
+// Abort discards everything written to the file so far and leaves any
+// existing file in place. The partial file of a resumable file is kept. The
+// file must not be used afterwards.
+func (f *MaybeCompressedFile) Abort() error {
+	if f.w == nil {
+		return ErrFileNotWriteable
+	}
+	return f.w.Abort()
+}
+
 func (f *MaybeCompressedFile) Close() error {
 	if f.r != nil {
 		return f.r.Close()
@@ -101,6 +138,9 @@ func mkdirAll(dir string) error {
 // compresswriter optionally compresses everything that is written to it.
 type compresswriter struct {
 	filename string
+	// partial keeps the data in filename plus partSuffix, instead of an
+	// anonymous temporary file, and appends to an existing one.
+	partial  bool
 	tempfile *os.File
 	bw       *bufio.Writer
 	written  int
@@ -108,6 +148,23 @@ type compresswriter struct {
 
 // init initializes internal fields
 func (w *compresswriter) init() error {
+	if w.partial {
+		if err := mkdirAll(path.Dir(w.filename)); err != nil {
+			return err
+		}
+		tf, err := os.OpenFile(w.filename+partSuffix, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		size, err := tf.Seek(0, os.SEEK_END)
+		if err != nil {
+			tf.Close()
+			return err
+		}
+		w.tempfile, w.written = tf, int(size)
+		w.bw = bufio.NewWriter(tf)
+		return nil
+	}
 	tf, err := ioutil.TempFile("", "compresswriter-")
 	if err != nil {
 		return err
@@ -117,6 +174,42 @@ func (w *compresswriter) init() error {
 	return nil
 }
 
+// Sync flushes and syncs the temporary file and returns its size.
+func (w *compresswriter) Sync() (int64, error) {
+	if w.tempfile == nil {
+		if err := w.init(); err != nil {
+			return 0, err
+		}
+	}
+	if err := w.bw.Flush(); err != nil {
+		return 0, err
+	}
+	if err := w.tempfile.Sync(); err != nil {
+		return 0, err
+	}
+	return int64(w.written), nil
+}
+
+// Truncate shortens the temporary file to size and continues writing there.
+func (w *compresswriter) Truncate(size int64) error {
+	if w.tempfile == nil {
+		if err := w.init(); err != nil {
+			return err
+		}
+	}
+	if err := w.bw.Flush(); err != nil {
+		return err
+	}
+	if err := w.tempfile.Truncate(size); err != nil {
+		return err
+	}
+	if _, err := w.tempfile.Seek(size, os.SEEK_SET); err != nil {
+		return err
+	}
+	w.written = int(size)
+	return nil
+}
+
 func (w *compresswriter) Write(p []byte) (n int, err error) {
 	if w.tempfile == nil {
 		if err := w.init(); err != nil {
@@ -184,6 +277,25 @@ func (w *compresswriter) Close() error {
 	return nil
 }
 
+// Abort removes the temporary file without touching the target. A partial
+// file is kept.
+func (w *compresswriter) Abort() error {
+	if w.tempfile == nil {
+		return nil
+	}
+	if w.partial {
+		if err := w.bw.Flush(); err != nil {
+			w.tempfile.Close()
+			return err
+		}
+		return w.tempfile.Close()
+	}
+	if err := w.tempfile.Close(); err != nil {
+		return err
+	}
+	return os.Remove(w.tempfile.Name())
+}
+
 type compressreader struct {
 	file *os.File
 	r    io.Reader
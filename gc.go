@@ -0,0 +1,403 @@
+//  Copyright 2015 by Leipzig University Library, http://ub.uni-leipzig.de
+//                    The Finc Authors, http://finc.info
+//                    Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+//
+package oaimi
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrNoSizes is returned, if a size limit is requested for a store, that
+// cannot tell the size of its keys.
+var ErrNoSizes = errors.New("store cannot tell sizes")
+
+// tempPatterns match the temporary files of shard writers in the temporary
+// directory of the OS.
+var tempPatterns = []string{"compresswriter-*", "kvstore-*", "s3store-*"}
+
+// leftover matches the temporary files of WriteFileAtomic and compresswriter,
+// which are named after their target followed by a random number and stay
+// behind, if a process is killed while writing. Checkpoints are written with
+// WriteFileAtomic, too.
+var leftover = regexp.MustCompile(`(\.xml\.gz-?|` + regexp.QuoteMeta(".xml.gz"+checkpointSuffix) + `|` +
+	regexp.QuoteMeta(LayoutFilename) + `|` + regexp.QuoteMeta(ManifestFilename) + `)[0-9]+$`)
+
+// GCPolicy tells CollectGarbage, what to remove from a cache. Zero values
+// disable a policy.
+type GCPolicy struct {
+	// MaxSize limits the total stored size of all shards in bytes, the least
+	// recently retrieved shards are removed first.
+	MaxSize int64
+	// MaxAge removes shards, as well as partial files and checkpoints of
+	// interrupted retrievals, written longer ago.
+	MaxAge time.Duration
+	// KeepLatest keeps only the shards of the most recently harvested
+	// requests, i.e. verb, format and set, of each endpoint.
+	KeepLatest int
+	// Stale is the age, after which leftovers of interrupted writes are
+	// removed.
+	Stale time.Duration
+	// DryRun only reports, what would be removed.
+	DryRun bool
+}
+
+// Removal is a file removed from a cache.
+type Removal struct {
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	Reason string `json:"reason"`
+}
+
+// gcShard is a shard considered for removal.
+type gcShard struct {
+	key      string
+	size     int64
+	modified time.Time
+}
+
+// endpointOf returns the endpoint prefix of a request prefix, e.g.
+// example.com/oai for example.com/oai/ListRecords/oai_dc/set-a.
+func endpointOf(prefix string) string {
+	parts := strings.Split(prefix, "/")
+	for i := len(parts) - 1; i >= 0; i-- {
+		switch parts[i] {
+		case "ListRecords", "ListIdentifiers", "ListSets":
+			return path.Join(parts[:i]...)
+		}
+	}
+	return prefix
+}
+
+// CollectGarbage removes shards below a prefix according to a policy, together
+// with leftovers of interrupted writes. Manifests are updated, layouts and
+// manifests of requests without shards are removed.
+func CollectGarbage(store CacheStore, prefix string, policy GCPolicy) ([]Removal, error) {
+	sized, ok := store.(sizedStore)
+	if !ok && policy.MaxSize > 0 {
+		return nil, ErrNoSizes
+	}
+	sizeOf := func(key string) (int64, error) {
+		if sized == nil {
+			return 0, nil
+		}
+		return sized.Size(key)
+	}
+	keys, err := store.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var removals []Removal
+	remove := func(key string, size int64, reason string) error {
+		if !policy.DryRun {
+			if err := store.Delete(key); err != nil {
+				return err
+			}
+		}
+		removals = append(removals, Removal{Key: key, Size: size, Reason: reason})
+		return nil
+	}
+	// removeShard takes the lock of a shard, like a retrieval does, and skips
+	// shards, that are being retrieved or have been replaced since listing
+	removeShard := func(s gcShard, reason string) (bool, error) {
+		if ls, ok := store.(lockingStore); ok && !policy.DryRun {
+			// with a done context, Lock tries only once
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			unlock, err := ls.Lock(ctx, s.key)
+			if err == context.Canceled {
+				return false, nil
+			}
+			if err != nil {
+				return false, err
+			}
+			defer unlock()
+			modified, ok, err := store.Exists(s.key)
+			if err != nil {
+				return false, err
+			}
+			if !ok || !modified.Equal(s.modified) {
+				return false, nil
+			}
+		}
+		if err := remove(s.key, s.size, reason); err != nil {
+			return false, err
+		}
+		// the lock file is not needed anymore; waiting processes notice
+		// its removal, see FileStore.Lock
+		if fs, ok := asFileStore(store); ok && !policy.DryRun {
+			if err := os.Remove(fs.path(s.key) + lockSuffix); err != nil && !os.IsNotExist(err) {
+				return true, err
+			}
+		}
+		return true, nil
+	}
+	now := time.Now()
+	var shards []gcShard
+	for _, key := range keys {
+		name := path.Base(key)
+		if !leftover.MatchString(name) && !strings.HasSuffix(name, ".xml.gz") {
+			continue
+		}
+		modified, ok, err := store.Exists(key)
+		if err != nil {
+			return removals, err
+		}
+		if !ok {
+			continue
+		}
+		size, err := sizeOf(key)
+		if err != nil {
+			return removals, err
+		}
+		if !leftover.MatchString(name) {
+			shards = append(shards, gcShard{key: key, size: size, modified: modified})
+			continue
+		}
+		if policy.Stale > 0 && now.Sub(modified) > policy.Stale {
+			if err := remove(key, size, "leftover"); err != nil {
+				return removals, err
+			}
+		}
+	}
+
+	reasons := make(map[string]string)
+	if policy.KeepLatest > 0 {
+		latest := make(map[string]time.Time)
+		for _, s := range shards {
+			if dir := path.Dir(s.key); s.modified.After(latest[dir]) {
+				latest[dir] = s.modified
+			}
+		}
+		byEndpoint := make(map[string][]string)
+		for dir := range latest {
+			endpoint := endpointOf(dir)
+			byEndpoint[endpoint] = append(byEndpoint[endpoint], dir)
+		}
+		drop := make(map[string]bool)
+		for _, dirs := range byEndpoint {
+			sort.Slice(dirs, func(i, j int) bool { return latest[dirs[i]].After(latest[dirs[j]]) })
+			for i := policy.KeepLatest; i < len(dirs); i++ {
+				drop[dirs[i]] = true
+			}
+		}
+		for _, s := range shards {
+			if drop[path.Dir(s.key)] {
+				reasons[s.key] = "keep-latest"
+			}
+		}
+	}
+	if policy.MaxAge > 0 {
+		for _, s := range shards {
+			if reasons[s.key] == "" && now.Sub(s.modified) > policy.MaxAge {
+				reasons[s.key] = "max-age"
+			}
+		}
+	}
+	if policy.MaxSize > 0 {
+		var total int64
+		var kept []gcShard
+		for _, s := range shards {
+			if reasons[s.key] == "" {
+				total += s.size
+				kept = append(kept, s)
+			}
+		}
+		sort.SliceStable(kept, func(i, j int) bool { return kept[i].modified.Before(kept[j].modified) })
+		for _, s := range kept {
+			if total <= policy.MaxSize {
+				break
+			}
+			reasons[s.key] = "max-size"
+			total -= s.size
+		}
+	}
+
+	left := make(map[string]int)
+	for _, s := range shards {
+		dir := path.Dir(s.key)
+		if _, ok := left[dir]; !ok {
+			left[dir] = 0
+		}
+		if reason := reasons[s.key]; reason != "" {
+			removed, err := removeShard(s, reason)
+			if err != nil {
+				return removals, err
+			}
+			if removed {
+				continue
+			}
+			delete(reasons, s.key)
+		}
+		left[dir]++
+	}
+	if !policy.DryRun && len(reasons) > 0 {
+		if err := pruneManifests(store, left, reasons); err != nil {
+			return removals, err
+		}
+	}
+	if fs, ok := asFileStore(store); ok {
+		return fs.collectGarbage(prefix, policy, removals)
+	}
+	return removals, nil
+}
+
+// pruneManifests drops removed shards from the manifests and removes
+// manifests and layouts of requests without shards, given the number of
+// shards left per request prefix.
+func pruneManifests(store CacheStore, left map[string]int, removed map[string]string) error {
+	for dir, n := range left {
+		if n == 0 {
+			for _, name := range []string{ManifestFilename, LayoutFilename} {
+				if err := store.Delete(path.Join(dir, name)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		m, err := ReadManifest(store, dir)
+		if err != nil {
+			return err
+		}
+		var shards []ShardInfo
+		for _, si := range m.Shards {
+			if removed[path.Join(dir, si.Name)] == "" {
+				shards = append(shards, si)
+			}
+		}
+		if len(shards) == len(m.Shards) {
+			continue
+		}
+		m.Shards = shards
+		if err := writeManifest(store, dir, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectGarbage removes partial files and checkpoints older than the
+// maximum age, stale lock files, that are not held, and directories left
+// empty.
+func (s FileStore) collectGarbage(prefix string, policy GCPolicy, removals []Removal) ([]Removal, error) {
+	root := s.path(prefix)
+	var dirs []string
+	now := time.Now()
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() {
+			dirs = append(dirs, p)
+			return nil
+		}
+		if strings.HasSuffix(p, lockSuffix) {
+			if policy.Stale == 0 || now.Sub(fi.ModTime()) <= policy.Stale || policy.DryRun {
+				return nil
+			}
+			removed, err := removeLock(p)
+			if !removed || err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(s.Dir, p)
+			if err != nil {
+				return err
+			}
+			removals = append(removals, Removal{Key: filepath.ToSlash(rel), Reason: "leftover"})
+			return nil
+		}
+		if !strings.HasSuffix(p, partSuffix) && !strings.HasSuffix(p, checkpointSuffix) {
+			return nil
+		}
+		if policy.MaxAge == 0 || now.Sub(fi.ModTime()) <= policy.MaxAge {
+			return nil
+		}
+		if !policy.DryRun {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		rel, err := filepath.Rel(s.Dir, p)
+		if err != nil {
+			return err
+		}
+		removals = append(removals, Removal{Key: filepath.ToSlash(rel), Size: fi.Size(), Reason: "max-age"})
+		return nil
+	})
+	if err != nil || policy.DryRun {
+		return removals, err
+	}
+	// deepest first, so parents may become empty; removing a non-empty
+	// directory fails and is ignored
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if dirs[i] != filepath.Clean(s.Dir) {
+			os.Remove(dirs[i])
+		}
+	}
+	return removals, nil
+}
+
+// CleanTempFiles removes temporary files of shard writers from the temporary
+// directory of the OS, that have not been written to for a given duration and
+// have most likely been left behind by a killed process. A zero duration
+// removes nothing, since the files of running processes would be removed.
+func CleanTempFiles(olderThan time.Duration, dryRun bool) ([]Removal, error) {
+	var removals []Removal
+	if olderThan <= 0 {
+		return removals, nil
+	}
+	now := time.Now()
+	for _, pattern := range tempPatterns {
+		matches, err := filepath.Glob(filepath.Join(os.TempDir(), pattern))
+		if err != nil {
+			return removals, err
+		}
+		for _, fn := range matches {
+			fi, err := os.Lstat(fn)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return removals, err
+			}
+			if !fi.Mode().IsRegular() || now.Sub(fi.ModTime()) <= olderThan {
+				continue
+			}
+			if !dryRun {
+				if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+					return removals, err
+				}
+			}
+			removals = append(removals, Removal{Key: fn, Size: fi.Size(), Reason: "temp"})
+		}
+	}
+	return removals, nil
+}
@@ -0,0 +1,170 @@
+package oaimi
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	files := []struct {
+		key string
+		age time.Duration
+	}{
+		{"example.com/oai/ListRecords/oai_dc/2000-01-01-2000-01-07.xml.gz", 10 * day},
+		{"example.com/oai/ListRecords/oai_dc/2000-01-08-2000-01-14.xml.gz", 5 * day},
+		{"example.com/oai/ListRecords/oai_dc/2000-01-15-2000-01-21.xml.gz", 1 * day},
+		{"example.com/oai/ListRecords/oai_dc/2000-01-01-2000-01-07.xml.gz-123", 2 * day},
+		{"example.com/oai/ListRecords/oai_dc/manifest.json456", time.Minute},
+		{"example.com/oai/ListRecords/oai_dc/2000-01-22-2000-01-28.xml.gz.checkpoint789", 3 * day},
+		{"example.com/oai/ListRecords/oai_dc/2000-01-22-2000-01-28.xml.gz.part", 40 * day},
+		{"example.com/oai/ListRecords/marcxml/2000-01-01-2000-01-07.xml.gz", 20 * day},
+		{"example.com/oai/ListRecords/marcxml/layout.json", 20 * day},
+		{"example.com/oai/ListIdentifiers/oai_dc/2000-01-01-2000-01-07.xml.gz", 2 * day},
+	}
+	setup := func(t *testing.T) FileStore {
+		store := FileStore{Dir: t.TempDir()}
+		for _, f := range files {
+			fn := store.path(f.key)
+			if err := mkdirAll(filepath.Dir(fn)); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(fn, []byte(fmt.Sprintf("<x>%s</x>", f.key)), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(fn, now.Add(-f.age), now.Add(-f.age)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		m := Manifest{Endpoint: "http://example.com/oai", Verb: "ListRecords", Prefix: "oai_dc"}
+		m.update([]ShardInfo{
+			{Name: "2000-01-01-2000-01-07.xml.gz"},
+			{Name: "2000-01-08-2000-01-14.xml.gz"},
+			{Name: "2000-01-15-2000-01-21.xml.gz"},
+		})
+		if err := writeManifest(store, "example.com/oai/ListRecords/oai_dc", m); err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+	removed := func(removals []Removal) []string {
+		var keys []string
+		for _, r := range removals {
+			keys = append(keys, strings.TrimPrefix(r.Key, "example.com/oai/")+" "+r.Reason)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	for _, test := range []struct {
+		policy  GCPolicy
+		removed []string
+	}{
+		{GCPolicy{}, nil},
+		{GCPolicy{KeepLatest: 2, DryRun: true}, []string{
+			"ListRecords/marcxml/2000-01-01-2000-01-07.xml.gz keep-latest",
+		}},
+		{GCPolicy{MaxAge: 7 * day, Stale: day}, []string{
+			"ListRecords/marcxml/2000-01-01-2000-01-07.xml.gz max-age",
+			"ListRecords/oai_dc/2000-01-01-2000-01-07.xml.gz max-age",
+			"ListRecords/oai_dc/2000-01-01-2000-01-07.xml.gz-123 leftover",
+			"ListRecords/oai_dc/2000-01-22-2000-01-28.xml.gz.checkpoint789 leftover",
+			"ListRecords/oai_dc/2000-01-22-2000-01-28.xml.gz.part max-age",
+		}},
+		// only the most recent shard fits
+		{GCPolicy{MaxSize: 100}, []string{
+			"ListIdentifiers/oai_dc/2000-01-01-2000-01-07.xml.gz max-size",
+			"ListRecords/marcxml/2000-01-01-2000-01-07.xml.gz max-size",
+			"ListRecords/oai_dc/2000-01-01-2000-01-07.xml.gz max-size",
+			"ListRecords/oai_dc/2000-01-08-2000-01-14.xml.gz max-size",
+		}},
+	} {
+		store := setup(t)
+		removals, err := CollectGarbage(store, "", test.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := removed(removals); !reflect.DeepEqual(got, test.removed) {
+			t.Errorf("CollectGarbage(%+v) got %v, want %v", test.policy, got, test.removed)
+		}
+		for _, r := range removals {
+			_, err := os.Stat(store.path(r.Key))
+			if test.policy.DryRun != (err == nil) {
+				t.Errorf("%s: dry run %v, got %v", r.Key, test.policy.DryRun, err)
+			}
+		}
+	}
+
+	store := setup(t)
+	if _, err := CollectGarbage(store, "", GCPolicy{MaxAge: 7 * day}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadManifest(store, "example.com/oai/ListRecords/oai_dc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Shards) != 2 {
+		t.Errorf("got %d manifest entries, want 2", len(m.Shards))
+	}
+	if _, err := os.Stat(store.path("example.com/oai/ListRecords/marcxml")); !os.IsNotExist(err) {
+		t.Errorf("got %v, want request dir without shards removed", err)
+	}
+
+	// shards, that are locked by a retrieval, are kept
+	store = setup(t)
+	key := "example.com/oai/ListRecords/oai_dc/2000-01-01-2000-01-07.xml.gz"
+	unlock, err := store.Lock(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	removals, err := CollectGarbage(&store, "", GCPolicy{MaxAge: 7 * day})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range removals {
+		if r.Key == key {
+			t.Errorf("locked shard %s removed", key)
+		}
+	}
+	if m, err = ReadManifest(store, path.Dir(key)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.find(path.Base(key)); !ok {
+		t.Errorf("manifest entry of locked shard %s removed", key)
+	}
+}
+
+func TestCleanTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	fn := filepath.Join(dir, "kvstore-123")
+	if err := ioutil.WriteFile(fn, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(fn, old, old); err != nil {
+		t.Fatal(err)
+	}
+	removals, err := CleanTempFiles(0, false)
+	if err != nil || len(removals) != 0 {
+		t.Errorf("CleanTempFiles(0) got %v, %v, want nothing removed", removals, err)
+	}
+	removals, err = CleanTempFiles(time.Hour, false)
+	if err != nil || len(removals) != 1 || removals[0].Key != fn {
+		t.Errorf("CleanTempFiles(1h) got %v, %v, want %s", removals, err, fn)
+	}
+	if _, err := os.Stat(fn); !os.IsNotExist(err) {
+		t.Errorf("got %v, want temp file removed", err)
+	}
+}
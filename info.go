@@ -22,8 +22,8 @@
 package oaimi
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"strings"
 	"time"
 )
@@ -61,40 +61,39 @@ type message struct {
 
 var client = NewBatchingClient()
 
-// doRequest executes a given OAI request and sends a message back a message.
-// The request can be cancelled through the quit channel.
-// TODO(miku): use https://blog.golang.org/context
-func doRequest(req Request, resp chan message, quit chan bool) {
-	ch := make(chan message)
-	go func() {
-		r, err := client.Do(req)
-		ch <- message{request: req, response: r, err: err}
-	}()
-	for {
-		select {
-		case <-quit:
-			break
-		case msg := <-ch:
-			resp <- msg
-			break
-		}
-	}
+// doRequest executes a given OAI request and sends back a message. The
+// channel must be buffered, so the goroutine can exit, even if nobody is
+// listening anymore.
+func doRequest(ctx context.Context, req Request, resp chan<- message) {
+	r, err := client.DoContext(ctx, req)
+	resp <- message{request: req, response: r, err: err}
 }
 
 // AboutEndpoint returns information about a repository. Execution time
 // limited by timeout.
 func AboutEndpoint(endpoint string, timeout time.Duration) (*RepositoryInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return AboutEndpointContext(ctx, endpoint)
+}
+
+// AboutEndpointContext returns information about a repository. Pending
+// requests are cancelled, when the context is done.
+func AboutEndpointContext(ctx context.Context, endpoint string) (*RepositoryInfo, error) {
 	start := time.Now()
 
 	if !strings.HasPrefix(endpoint, "http") {
 		endpoint = "http://" + endpoint
 	}
 
-	resp := make(chan message)
-	quit := make(chan bool)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	verbs := []string{"Identify", "ListSets", "ListMetadataFormats"}
+	resp := make(chan message, len(verbs))
 
-	for _, verb := range []string{"Identify", "ListSets", "ListMetadataFormats"} {
-		go doRequest(Request{Endpoint: endpoint, Verb: verb}, resp, quit)
+	for _, verb := range verbs {
+		go doRequest(ctx, Request{Endpoint: endpoint, Verb: verb}, resp)
 	}
 
 	info := &RepositoryInfo{Endpoint: endpoint, Errors: make([]error, 0)}
@@ -102,10 +101,7 @@ func AboutEndpoint(endpoint string, timeout time.Duration) (*RepositoryInfo, err
 		info.Elapsed = time.Since(start).Seconds()
 	}()
 
-	var received int
-	expired := time.After(timeout)
-
-	for {
+	for received := 0; received < len(verbs); received++ {
 		select {
 		case msg := <-resp:
 			switch msg.request.Verb {
@@ -119,16 +115,8 @@ func AboutEndpoint(endpoint string, timeout time.Duration) (*RepositoryInfo, err
 			if msg.err != nil {
 				info.Errors = append(info.Errors, msg.err)
 			}
-			received++
-			if received == 3 {
-				return info, nil
-			}
-		case <-expired:
-			// TODO(miku): less brittle cancellation
-			for i := 0; i < 3-received; i++ {
-				quit <- true
-			}
-			return info, fmt.Errorf("timed out")
+		case <-ctx.Done():
+			return info, ctx.Err()
 		}
 	}
 	return info, nil
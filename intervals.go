@@ -27,8 +27,6 @@ import (
 	"github.com/jinzhu/now"
 )
 
-const oneDay = 24 * time.Hour
-
 // Window represent a span of time, from and until including.
 type Window struct {
 	From  time.Time
@@ -37,6 +35,10 @@ type Window struct {
 
 type TimeShiftFunc func(time.Time) time.Time
 
+// makeWindows splits the window into consecutive windows, whose bounds are
+// given by the shift functions. The first window never starts before the
+// beginning of the day of From, the last window ends at the end of the day of
+// Until, or earlier, if the shift function yields a finer bound.
 func (w Window) makeWindows(left, right TimeShiftFunc) []Window {
 	var ws []Window
 	if w.From.After(w.Until) {
@@ -44,25 +46,40 @@ func (w Window) makeWindows(left, right TimeShiftFunc) []Window {
 	}
 	var start, end time.Time
 	from := w.From
+	last := now.New(w.Until).EndOfDay()
 	for {
-		switch {
-		case len(ws) == 0:
-			start = now.New(w.From).BeginningOfDay()
-		default:
-			start = left(from)
+		start = left(from)
+		if len(ws) == 0 {
+			if bod := now.New(w.From).BeginningOfDay(); start.Before(bod) {
+				start = bod
+			}
 		}
 		end = right(from)
-		if end.After(w.Until) {
-			// discard end and use the end of day of until
-			ws = append(ws, Window{From: start, Until: now.New(w.Until).EndOfDay()})
+		if !end.Before(w.Until) {
+			// discard end and use the end of day of until, if it comes first
+			if last.Before(end) {
+				end = last
+			}
+			ws = append(ws, Window{From: start, Until: end})
 			break
 		}
 		ws = append(ws, Window{From: start, Until: end})
-		from = end.Add(oneDay)
+		from = end.Add(time.Nanosecond)
 	}
 	return ws
 }
 
+// Yearly splits the window into calendar years.
+func (w Window) Yearly() []Window {
+	shiftLeft := func(t time.Time) time.Time {
+		return now.New(t).BeginningOfYear()
+	}
+	shiftRight := func(t time.Time) time.Time {
+		return now.New(t).EndOfYear()
+	}
+	return w.makeWindows(shiftLeft, shiftRight)
+}
+
 func (w Window) Monthly() []Window {
 	shiftLeft := func(t time.Time) time.Time {
 		return now.New(t).BeginningOfMonth()
@@ -82,3 +99,26 @@ func (w Window) Weekly() []Window {
 	}
 	return w.makeWindows(shiftLeft, shiftRight)
 }
+
+// Daily splits the window into days.
+func (w Window) Daily() []Window {
+	shiftLeft := func(t time.Time) time.Time {
+		return now.New(t).BeginningOfDay()
+	}
+	shiftRight := func(t time.Time) time.Time {
+		return now.New(t).EndOfDay()
+	}
+	return w.makeWindows(shiftLeft, shiftRight)
+}
+
+// Hourly splits the window into hours, which is only useful for repositories
+// supporting second granularity.
+func (w Window) Hourly() []Window {
+	shiftLeft := func(t time.Time) time.Time {
+		return now.New(t).BeginningOfHour()
+	}
+	shiftRight := func(t time.Time) time.Time {
+		return now.New(t).EndOfHour()
+	}
+	return w.makeWindows(shiftLeft, shiftRight)
+}
@@ -111,6 +111,16 @@ func TestWindowWeekly(t *testing.T) {
 				},
 			},
 		},
+		{
+			// until falls on the very end of a week
+			w: Window{From: time.Date(2000, 1, 3, 0, 0, 0, 0, time.UTC), Until: time.Date(2000, 1, 8, 23, 59, 59, 999999999, time.UTC)},
+			ws: []Window{
+				Window{
+					From:  time.Date(2000, 1, 3, 0, 0, 0, 0, time.UTC),
+					Until: time.Date(2000, 1, 8, 23, 59, 59, 999999999, time.UTC),
+				},
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -120,3 +130,104 @@ func TestWindowWeekly(t *testing.T) {
 		}
 	}
 }
+
+func TestWindowHourly(t *testing.T) {
+	var tests = []struct {
+		w  Window
+		ws []Window
+	}{
+		{
+			w: Window{From: time.Date(2000, 1, 1, 10, 30, 0, 0, time.UTC), Until: time.Date(2000, 1, 1, 12, 15, 0, 0, time.UTC)},
+			ws: []Window{
+				Window{
+					From:  time.Date(2000, 1, 1, 10, 0, 0, 0, time.UTC),
+					Until: time.Date(2000, 1, 1, 10, 59, 59, 999999999, time.UTC),
+				},
+				Window{
+					From:  time.Date(2000, 1, 1, 11, 0, 0, 0, time.UTC),
+					Until: time.Date(2000, 1, 1, 11, 59, 59, 999999999, time.UTC),
+				},
+				Window{
+					From:  time.Date(2000, 1, 1, 12, 0, 0, 0, time.UTC),
+					Until: time.Date(2000, 1, 1, 12, 59, 59, 999999999, time.UTC),
+				},
+			},
+		},
+		{
+			w: Window{From: time.Date(2000, 1, 1, 10, 30, 0, 0, time.UTC), Until: time.Date(2000, 1, 1, 10, 59, 59, 999999999, time.UTC)},
+			ws: []Window{
+				Window{
+					From:  time.Date(2000, 1, 1, 10, 0, 0, 0, time.UTC),
+					Until: time.Date(2000, 1, 1, 10, 59, 59, 999999999, time.UTC),
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		result := test.w.Hourly()
+		if !reflect.DeepEqual(result, test.ws) {
+			t.Errorf("Hourly() got %v, want %v", result, test.ws)
+		}
+	}
+}
+
+func TestWindowYearly(t *testing.T) {
+	var tests = []struct {
+		w  Window
+		ws []Window
+	}{
+		{
+			w: Window{From: time.Date(1999, 6, 1, 12, 0, 0, 0, time.UTC), Until: time.Date(2001, 2, 1, 0, 0, 0, 0, time.UTC)},
+			ws: []Window{
+				Window{
+					From:  time.Date(1999, 6, 1, 0, 0, 0, 0, time.UTC),
+					Until: time.Date(1999, 12, 31, 23, 59, 59, 999999999, time.UTC),
+				},
+				Window{
+					From:  time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+					Until: time.Date(2000, 12, 31, 23, 59, 59, 999999999, time.UTC),
+				},
+				Window{
+					From:  time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC),
+					Until: time.Date(2001, 2, 1, 23, 59, 59, 999999999, time.UTC),
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		result := test.w.Yearly()
+		if !reflect.DeepEqual(result, test.ws) {
+			t.Errorf("Yearly() got %v, want %v", result, test.ws)
+		}
+	}
+}
+
+func TestWindowDaily(t *testing.T) {
+	var tests = []struct {
+		w  Window
+		ws []Window
+	}{
+		{
+			w: Window{From: time.Date(2000, 1, 1, 12, 0, 0, 0, time.UTC), Until: time.Date(2000, 1, 2, 8, 0, 0, 0, time.UTC)},
+			ws: []Window{
+				Window{
+					From:  time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+					Until: time.Date(2000, 1, 1, 23, 59, 59, 999999999, time.UTC),
+				},
+				Window{
+					From:  time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC),
+					Until: time.Date(2000, 1, 2, 23, 59, 59, 999999999, time.UTC),
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		result := test.w.Daily()
+		if !reflect.DeepEqual(result, test.ws) {
+			t.Errorf("Daily() got %v, want %v", result, test.ws)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+//  Copyright 2015 by Leipzig University Library, http://ub.uni-leipzig.de
+//                    The Finc Authors, http://finc.info
+//                    Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+//
+package oaimi
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+// RecordIterator walks over the records of a ListRecords or the headers of a
+// ListIdentifiers request and follows resumption tokens. Responses are
+// decoded token by token, so only a single record is held in memory at a
+// time.
+//
+//     it := NewRecordIterator(req)
+//     defer it.Close()
+//     for it.Next() {
+//         record := it.Record()
+//         ...
+//     }
+//     if err := it.Err(); err != nil {
+//         ...
+//     }
+type RecordIterator struct {
+	// MaxRequests, zero means no limit. Default of 16384 will prevent endless
+	// loop due to broken resumptionToken implementations.
+	MaxRequests int
+	// client executes the requests.
+	client Client
+	ctx    context.Context
+	// req is the request for the next page.
+	req Request
+	// body and rr belong to the current page.
+	body     io.ReadCloser
+	rr       *recordReader
+	requests int
+	record   Record
+	done     bool
+	err      error
+}
+
+// NewRecordIterator returns an iterator over the records of a ListRecords or
+// ListIdentifiers request, that uses a resilient HTTP client.
+func NewRecordIterator(req Request) *RecordIterator {
+	return NewRecordIteratorClient(NewClient(), req)
+}
+
+// NewRecordIteratorClient returns an iterator, that uses the given client.
+func NewRecordIteratorClient(client Client, req Request) *RecordIterator {
+	return NewRecordIteratorContext(context.Background(), client, req)
+}
+
+// NewRecordIteratorContext returns an iterator, that uses the given client.
+// Once the context is done, the iteration stops with the context error.
+func NewRecordIteratorContext(ctx context.Context, client Client, req Request) *RecordIterator {
+	return &RecordIterator{client: client, ctx: ctx, req: req, MaxRequests: 16384}
+}
+
+// Next advances the iterator to the next record. It returns false, if there
+// are no more records or an error occured.
+func (it *RecordIterator) Next() bool {
+	if it.done || it.err != nil {
+		return false
+	}
+	for {
+		if it.rr == nil {
+			if err := it.openPage(); err != nil {
+				it.fail(err)
+				return false
+			}
+		}
+		err := it.rr.next(&it.record)
+		switch {
+		case err == nil:
+			return true
+		case err == io.EOF:
+			token := it.rr.token
+			it.closePage()
+			if token == "" {
+				it.done = true
+				return false
+			}
+			it.req.ResumptionToken = token
+		case err == errNoRecordsMatch:
+			it.closePage()
+			it.done = true
+			return false
+		default:
+			it.fail(err)
+			return false
+		}
+	}
+}
+
+// Record returns the current record. For ListIdentifiers only the header is
+// populated.
+func (it *RecordIterator) Record() Record {
+	return it.record
+}
+
+// Err returns the first error encountered during iteration. A noRecordsMatch
+// condition is not considered an error.
+func (it *RecordIterator) Err() error {
+	return it.err
+}
+
+// Close releases the current response, if any. It is safe to call Close
+// after the iteration has finished.
+func (it *RecordIterator) Close() error {
+	it.done = true
+	return it.closePage()
+}
+
+// openPage requests the next page.
+func (it *RecordIterator) openPage() error {
+	switch it.req.Verb {
+	case "ListRecords", "ListIdentifiers":
+	default:
+		return ErrBadVerb
+	}
+	if it.MaxRequests > 0 && it.requests == it.MaxRequests {
+		return ErrTooManyRequests
+	}
+	body, err := it.client.open(it.ctx, it.req)
+	if err != nil {
+		return err
+	}
+	it.requests++
+	it.body, it.rr = body, newRecordReader(body)
+	return nil
+}
+
+// closePage releases the current page.
+func (it *RecordIterator) closePage() error {
+	if it.body == nil {
+		return nil
+	}
+	err := it.body.Close()
+	it.body, it.rr = nil, nil
+	return err
+}
+
+// fail records an error and releases the current page. If the context is
+// done, its error takes precedence.
+func (it *RecordIterator) fail(err error) {
+	if cerr := it.ctx.Err(); cerr != nil {
+		err = cerr
+	}
+	it.err = err
+	it.closePage()
+}
+
+// errNoRecordsMatch signals an empty list.
+var errNoRecordsMatch = OAIError{Code: "noRecordsMatch"}
+
+// recordReader decodes records or headers from a stream of one or more OAI
+// responses, e.g. a single page or a cached shard.
+type recordReader struct {
+	dec *xml.Decoder
+	// token is the last resumption token seen.
+	token string
+	// start and end locate the last record or header in the input.
+	start, end int64
+}
+
+func newRecordReader(r io.Reader) *recordReader {
+	dec := xml.NewDecoder(r)
+	dec.CharsetReader = CharsetReader
+	return &recordReader{dec: dec}
+}
+
+// next decodes the next record into rec. For ListIdentifiers responses, only
+// the header is populated. Returns io.EOF at the end of the stream and
+// errNoRecordsMatch or an OAIError, if the response contains an error.
+func (rr *recordReader) next(rec *Record) error {
+	for {
+		start := rr.dec.InputOffset()
+		t, err := rr.dec.Token()
+		if err != nil {
+			return err
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch se.Name.Local {
+		case "record":
+			*rec = Record{}
+			err := rr.dec.DecodeElement(rec, &se)
+			rr.start, rr.end = start, rr.dec.InputOffset()
+			return err
+		case "header":
+			// A header outside of a record is a ListIdentifiers item.
+			*rec = Record{}
+			err := rr.dec.DecodeElement(&rec.Header, &se)
+			rr.start, rr.end = start, rr.dec.InputOffset()
+			return err
+		case "resumptionToken":
+			var token resumptionToken
+			if err := rr.dec.DecodeElement(&token, &se); err != nil {
+				return err
+			}
+			rr.token = strings.TrimSpace(token.Value)
+		case "error":
+			var e struct {
+				Code    string `xml:"code,attr"`
+				Message string `xml:",chardata"`
+			}
+			if err := rr.dec.DecodeElement(&e, &se); err != nil {
+				return err
+			}
+			// re-marshalled responses contain an empty error element
+			if e.Code == "" {
+				continue
+			}
+			if e.Code == "noRecordsMatch" {
+				return errNoRecordsMatch
+			}
+			return OAIError{Code: e.Code, Message: e.Message}
+		}
+	}
+}
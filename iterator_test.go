@@ -0,0 +1,135 @@
+package oaimi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// pagedHandler serves a ListRecords response in pages of two records and
+// signals the end of the list with an empty resumption token.
+func pagedHandler(identifiers []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var offset int
+		if token := r.URL.Query().Get("resumptionToken"); token != "" {
+			fmt.Sscanf(token, "%d", &offset)
+		}
+		fmt.Fprint(w, `<OAI-PMH><responseDate>2000-01-01T00:00:00Z</responseDate>`)
+		fmt.Fprint(w, `<request verb="ListRecords">http://example.com/oai</request><ListRecords>`)
+		for i := offset; i < offset+2 && i < len(identifiers); i++ {
+			fmt.Fprintf(w, `<record><header><identifier>%s</identifier>`+
+				`<datestamp>2000-01-01</datestamp></header>`+
+				`<metadata><dc>%d</dc></metadata><about><rights>%d</rights></about></record>`,
+				identifiers[i], i, i)
+		}
+		if offset+2 < len(identifiers) {
+			fmt.Fprintf(w, `<resumptionToken completeListSize="%d">%d</resumptionToken>`,
+				len(identifiers), offset+2)
+		} else {
+			fmt.Fprintf(w, `<resumptionToken completeListSize="%d"/>`, len(identifiers))
+		}
+		fmt.Fprint(w, `</ListRecords></OAI-PMH>`)
+	}
+}
+
+func TestRecordIterator(t *testing.T) {
+	ids := []string{"a", "b", "c", "d", "e"}
+	ts := httptest.NewServer(pagedHandler(ids))
+	defer ts.Close()
+
+	req := Request{Endpoint: ts.URL, Verb: "ListRecords", Prefix: "oai_dc"}
+	it := NewRecordIteratorClient(NewClientDoer(http.DefaultClient), req)
+	defer it.Close()
+
+	var got []string
+	for it.Next() {
+		r := it.Record()
+		got = append(got, r.Header.Identifier)
+		if want := fmt.Sprintf("<dc>%d</dc>", len(got)-1); r.Metadata.Verbatim != want {
+			t.Errorf("Metadata got %v, want %v", r.Metadata.Verbatim, want)
+		}
+		if len(r.About) != 1 {
+			t.Errorf("About got %d elements, want 1", len(r.About))
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Err() got %v, want nil", err)
+	}
+	if !reflect.DeepEqual(got, ids) {
+		t.Errorf("identifiers got %v, want %v", got, ids)
+	}
+}
+
+func TestRecordIteratorErrors(t *testing.T) {
+	var tests = []struct {
+		body string
+		err  error
+	}{
+		{`<OAI-PMH><error code="noRecordsMatch">empty</error></OAI-PMH>`, nil},
+		{`<OAI-PMH><error code="badArgument">bad</error></OAI-PMH>`,
+			OAIError{Code: "badArgument", Message: "bad"}},
+	}
+	for _, test := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, test.body)
+		}))
+		req := Request{Endpoint: ts.URL, Verb: "ListRecords"}
+		it := NewRecordIteratorClient(NewClientDoer(http.DefaultClient), req)
+		if it.Next() {
+			t.Errorf("Next() got true, want false")
+		}
+		if err := it.Err(); err != test.err {
+			t.Errorf("Err() got %v, want %v", err, test.err)
+		}
+		ts.Close()
+	}
+}
+
+func TestRecordIteratorMaxRequests(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<OAI-PMH><ListIdentifiers><header><identifier>x</identifier></header>`+
+			`<resumptionToken>same</resumptionToken></ListIdentifiers></OAI-PMH>`)
+	}))
+	defer ts.Close()
+
+	req := Request{Endpoint: ts.URL, Verb: "ListIdentifiers"}
+	it := NewRecordIteratorClient(NewClientDoer(http.DefaultClient), req)
+	it.MaxRequests = 3
+	var n int
+	for it.Next() {
+		if it.Record().Header.Identifier != "x" {
+			t.Errorf("Identifier got %v, want x", it.Record().Header.Identifier)
+		}
+		n++
+	}
+	if it.Err() != ErrTooManyRequests {
+		t.Errorf("Err() got %v, want %v", it.Err(), ErrTooManyRequests)
+	}
+	if n != 3 {
+		t.Errorf("got %d headers, want 3", n)
+	}
+}
+
+func TestRecordIteratorContext(t *testing.T) {
+	ts := httptest.NewServer(pagedHandler([]string{"a", "b", "c"}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := Request{Endpoint: ts.URL, Verb: "ListRecords"}
+	it := NewRecordIteratorContext(ctx, NewClientDoer(http.DefaultClient), req)
+	var n int
+	for it.Next() {
+		n++
+		cancel()
+	}
+	if n != 2 {
+		t.Errorf("got %d records, want 2", n)
+	}
+	if it.Err() != context.Canceled {
+		t.Errorf("Err() got %v, want %v", it.Err(), context.Canceled)
+	}
+}
@@ -0,0 +1,361 @@
+//  Copyright 2015 by Leipzig University Library, http://ub.uni-leipzig.de
+//                    The Finc Authors, http://finc.info
+//                    Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+//
+package oaimi
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrStoreClosed is returned by a KVStore after Close.
+	ErrStoreClosed = errors.New("store closed")
+	// ErrStoreLocked is returned by OpenKVStore, if the file is used by
+	// another KVStore, e.g. in another process.
+	ErrStoreLocked = errors.New("store is in use by another process")
+)
+
+// Records of a KVStore file start with a header of kvHeaderSize bytes: the
+// operation, the time of the write in nanoseconds since the epoch, the
+// length of the key and the length of the value.
+const (
+	kvPut        = 'P'
+	kvDelete     = 'D'
+	kvHeaderSize = 1 + 8 + 4 + 8
+)
+
+// kvEntry locates the latest value of a key in the file.
+type kvEntry struct {
+	offset   int64
+	size     int64
+	modified time.Time
+}
+
+// KVStore is an embedded key-value store, that keeps all shards of a cache in
+// a single append-only file. Values are stored gzip compressed. An index of
+// all keys is held in memory and rebuilt from the file on open. Space of
+// replaced and deleted values is reclaimed by Compact. A KVStore file can
+// only be opened by a single process at a time, it is locked while open.
+type KVStore struct {
+	mu    sync.RWMutex
+	file  *os.File
+	size  int64
+	index map[string]kvEntry
+}
+
+// OpenKVStore opens or creates a store file and takes an exclusive lock on
+// it. If the file is locked already, ErrStoreLocked is returned as part of a
+// *os.PathError. A last record, that has not been written completely, e.g.
+// due to a crash, is discarded. A corrupted record elsewhere is an error, the
+// file is left untouched then.
+func OpenKVStore(filename string) (*KVStore, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := tryLock(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !ok {
+		file.Close()
+		return nil, &os.PathError{Op: "open", Path: filename, Err: ErrStoreLocked}
+	}
+	s := &KVStore{file: file, index: make(map[string]kvEntry)}
+	if err := s.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load builds the index and truncates an incomplete last record. Fails on a
+// record with an unknown operation.
+func (s *KVStore) load() error {
+	fi, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(io.NewSectionReader(s.file, 0, fi.Size()))
+	var offset int64
+	header := make([]byte, kvHeaderSize)
+	for {
+		// a header, that has not been written completely, ends the file
+		if _, err := io.ReadFull(br, header); err != nil {
+			break
+		}
+		op := header[0]
+		modified := time.Unix(0, int64(binary.BigEndian.Uint64(header[1:9])))
+		klen := int64(binary.BigEndian.Uint32(header[9:13]))
+		vlen := int64(binary.BigEndian.Uint64(header[13:21]))
+		if op != kvPut && op != kvDelete {
+			return fmt.Errorf("%s: corrupted record at offset %d", s.file.Name(), offset)
+		}
+		// a record, that runs beyond the end of the file, is the last one
+		// and has not been written completely
+		if offset+kvHeaderSize+klen+vlen > fi.Size() {
+			break
+		}
+		key := make([]byte, klen)
+		if _, err := io.ReadFull(br, key); err != nil {
+			return err
+		}
+		if _, err := br.Discard(int(vlen)); err != nil {
+			return err
+		}
+		switch op {
+		case kvPut:
+			s.index[string(key)] = kvEntry{offset: offset + kvHeaderSize + klen, size: vlen, modified: modified}
+		case kvDelete:
+			delete(s.index, string(key))
+		}
+		offset += kvHeaderSize + klen + vlen
+	}
+	s.size = offset
+	if offset < fi.Size() {
+		return s.file.Truncate(offset)
+	}
+	return nil
+}
+
+// appendRecord writes a record with a value read from r, which has the given
+// size, and syncs the file. The caller must hold the write lock.
+func (s *KVStore) appendRecord(op byte, key string, r io.Reader, size int64, modified time.Time) (kvEntry, error) {
+	if s.file == nil {
+		return kvEntry{}, ErrStoreClosed
+	}
+	header := make([]byte, kvHeaderSize)
+	header[0] = op
+	binary.BigEndian.PutUint64(header[1:9], uint64(modified.UnixNano()))
+	binary.BigEndian.PutUint32(header[9:13], uint32(len(key)))
+	binary.BigEndian.PutUint64(header[13:21], uint64(size))
+	if _, err := s.file.Seek(s.size, io.SeekStart); err != nil {
+		return kvEntry{}, err
+	}
+	bw := bufio.NewWriter(s.file)
+	bw.Write(header)
+	bw.WriteString(key)
+	if r != nil {
+		if _, err := io.CopyN(bw, r, size); err != nil {
+			s.file.Truncate(s.size)
+			return kvEntry{}, err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		s.file.Truncate(s.size)
+		return kvEntry{}, err
+	}
+	if err := s.file.Sync(); err != nil {
+		return kvEntry{}, err
+	}
+	e := kvEntry{offset: s.size + kvHeaderSize + int64(len(key)), size: size, modified: modified}
+	s.size = e.offset + size
+	return e, nil
+}
+
+func (s *KVStore) Exists(key string) (time.Time, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.file == nil {
+		return time.Time{}, false, ErrStoreClosed
+	}
+	e, ok := s.index[key]
+	return e.modified, ok, nil
+}
+
+func (s *KVStore) Open(key string) (io.ReadCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.file == nil {
+		return nil, ErrStoreClosed
+	}
+	e, ok := s.index[key]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: key, Err: os.ErrNotExist}
+	}
+	// values are never overwritten in place, so the section stays valid
+	// until the next Compact
+	gz, err := gzip.NewReader(io.NewSectionReader(s.file, e.offset, e.size))
+	if err != nil {
+		return nil, err
+	}
+	return gz, nil
+}
+
+func (s *KVStore) Create(key string) (ShardWriter, error) {
+	tf, err := ioutil.TempFile("", "kvstore-")
+	if err != nil {
+		return nil, err
+	}
+	return &kvWriter{store: s, key: key, tempfile: tf, gz: gzip.NewWriter(tf)}, nil
+}
+
+func (s *KVStore) List(prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.file == nil {
+		return nil, ErrStoreClosed
+	}
+	prefix = listPrefix(prefix)
+	var keys []string
+	for k := range s.index {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Size returns the compressed size of a value.
+func (s *KVStore) Size(key string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.file == nil {
+		return 0, ErrStoreClosed
+	}
+	e, ok := s.index[key]
+	if !ok {
+		return 0, &os.PathError{Op: "size", Path: key, Err: os.ErrNotExist}
+	}
+	return e.size, nil
+}
+
+func (s *KVStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.index[key]; !ok {
+		return nil
+	}
+	if _, err := s.appendRecord(kvDelete, key, nil, 0, time.Now()); err != nil {
+		return err
+	}
+	delete(s.index, key)
+	return nil
+}
+
+// Compact rewrites the store file with the latest values only. Readers
+// returned by Open must be closed before.
+func (s *KVStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return ErrStoreClosed
+	}
+	name := s.file.Name()
+	tf, err := ioutil.TempFile(filepath.Dir(name), "kvstore-")
+	if err != nil {
+		return err
+	}
+	// the new file replaces the locked one, so it is locked before
+	if ok, err := tryLock(tf); !ok || err != nil {
+		tf.Close()
+		os.Remove(tf.Name())
+		if err == nil {
+			err = ErrStoreLocked
+		}
+		return err
+	}
+	compacted := &KVStore{file: tf, index: make(map[string]kvEntry)}
+	for k, e := range s.index {
+		ne, err := compacted.appendRecord(kvPut, k, io.NewSectionReader(s.file, e.offset, e.size), e.size, e.modified)
+		if err != nil {
+			tf.Close()
+			os.Remove(tf.Name())
+			return err
+		}
+		compacted.index[k] = ne
+	}
+	if err := os.Rename(tf.Name(), name); err != nil {
+		tf.Close()
+		os.Remove(tf.Name())
+		return err
+	}
+	s.file.Close()
+	s.file, s.size, s.index = tf, compacted.size, compacted.index
+	return nil
+}
+
+// Close closes the store file.
+func (s *KVStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// kvWriter compresses a value into a temporary file, which is appended to
+// the store on Close.
+type kvWriter struct {
+	store    *KVStore
+	key      string
+	tempfile *os.File
+	gz       *gzip.Writer
+}
+
+func (w *kvWriter) Write(p []byte) (int, error) {
+	return w.gz.Write(p)
+}
+
+func (w *kvWriter) Close() error {
+	defer os.Remove(w.tempfile.Name())
+	defer w.tempfile.Close()
+	if err := w.gz.Close(); err != nil {
+		return err
+	}
+	size, err := w.tempfile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := w.tempfile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w.store.mu.Lock()
+	defer w.store.mu.Unlock()
+	e, err := w.store.appendRecord(kvPut, w.key, w.tempfile, size, time.Now())
+	if err != nil {
+		return err
+	}
+	w.store.index[w.key] = e
+	return nil
+}
+
+func (w *kvWriter) Abort() error {
+	w.tempfile.Close()
+	return os.Remove(w.tempfile.Name())
+}
@@ -0,0 +1,285 @@
+//  Copyright 2015 by Leipzig University Library, http://ub.uni-leipzig.de
+//                    The Finc Authors, http://finc.info
+//                    Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+//
+package oaimi
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LayoutFilename is the name of the file in a request cache dir, that records
+// the windows chosen by adaptive harvesting.
+const LayoutFilename = "layout.json"
+
+// splitters are used by adaptive harvesting, from coarse to fine. Hourly
+// windows are only used with second granularity, see levels.
+var splitters = []func(Window) []Window{
+	Window.Yearly,
+	Window.Monthly,
+	Window.Weekly,
+	Window.Daily,
+	Window.Hourly,
+}
+
+// levels returns the number of splitters, that can be used with a
+// granularity. Windows smaller than a day cannot be requested, unless the
+// repository supports second granularity.
+func levels(granularity string) int {
+	if granularity == GranularitySecond {
+		return len(splitters)
+	}
+	return len(splitters) - 1
+}
+
+// layout is the persisted list of windows of a request cache dir.
+type layout struct {
+	Windows []Window `json:"windows"`
+}
+
+// readLayout returns the persisted windows of the shards below a store
+// prefix, sorted by start. A missing layout file is not an error.
+func readLayout(store CacheStore, prefix string) ([]Window, error) {
+	rc, err := store.Open(path.Join(prefix, LayoutFilename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	var l layout
+	if err := json.Unmarshal(b, &l); err != nil {
+		return nil, err
+	}
+	sort.Slice(l.Windows, func(i, j int) bool { return l.Windows[i].From.Before(l.Windows[j].From) })
+	return l.Windows, nil
+}
+
+// writeLayout persists windows next to the shards below a store prefix.
+func writeLayout(store CacheStore, prefix string, windows []Window) error {
+	sort.Slice(windows, func(i, j int) bool { return windows[i].From.Before(windows[j].From) })
+	b, err := json.Marshal(layout{Windows: windows})
+	if err != nil {
+		return err
+	}
+	w, err := store.Create(path.Join(prefix, LayoutFilename))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// gaps returns the parts of w, that are not covered by the given sorted and
+// non-overlapping windows.
+func gaps(w Window, windows []Window) []Window {
+	var result []Window
+	cursor := w.From
+	for _, v := range windows {
+		if v.Until.Before(cursor) {
+			continue
+		}
+		if v.From.After(w.Until) {
+			break
+		}
+		if v.From.After(cursor) {
+			result = append(result, Window{From: cursor, Until: v.From.Add(-time.Nanosecond)})
+		}
+		cursor = v.Until.Add(time.Nanosecond)
+	}
+	if !cursor.After(w.Until) {
+		result = append(result, Window{From: cursor, Until: w.Until})
+	}
+	return result
+}
+
+// overlapping returns the windows, that overlap with w.
+func overlapping(w Window, windows []Window) []Window {
+	var result []Window
+	for _, v := range windows {
+		if v.Until.Before(w.From) || v.From.After(w.Until) {
+			continue
+		}
+		result = append(result, v)
+	}
+	return result
+}
+
+// probe requests the first page of a window and reports the number of
+// records in the window. If the repository does not report a
+// completeListSize, known is false and the size is only accurate, if there is
+// just a single page.
+func probe(ctx context.Context, client Client, req Request) (size int, known bool, err error) {
+	resp, err := client.DoContext(ctx, req)
+	if err != nil {
+		if e, ok := err.(OAIError); ok && e.Code == "noRecordsMatch" {
+			return 0, true, nil
+		}
+		return 0, false, err
+	}
+	var token resumptionToken
+	switch req.Verb {
+	case "ListIdentifiers":
+		token, size = resp.ListIdentifiers.Token, len(resp.ListIdentifiers.Header)
+	case "ListRecords":
+		token, size = resp.ListRecords.Token, len(resp.ListRecords.Records)
+	}
+	if strings.TrimSpace(token.Value) == "" {
+		return size, true, nil
+	}
+	if n, err := strconv.Atoi(strings.TrimSpace(token.CompleteListSize)); err == nil {
+		return n, true, nil
+	}
+	return size, false, nil
+}
+
+// sizedWindow is a window together with its number of records, if known.
+type sizedWindow struct {
+	Window
+	size  int
+	known bool
+}
+
+// merge joins adjacent windows, as long as the joined window holds at most
+// max records, so sparse time spans end up in a single window. Windows of
+// unknown size and windows, that end after closed, are kept as they are.
+func merge(windows []sizedWindow, max int, closed time.Time) []Window {
+	var result []Window
+	var cur *sizedWindow
+	for i := range windows {
+		v := windows[i]
+		mergeable := v.known && !v.Until.After(closed)
+		if cur != nil && mergeable && cur.size+v.size <= max && v.From.Equal(cur.Until.Add(time.Nanosecond)) {
+			cur.Until, cur.size = v.Until, cur.size+v.size
+			continue
+		}
+		if cur != nil {
+			result = append(result, cur.Window)
+			cur = nil
+		}
+		if mergeable {
+			cur = &v
+			continue
+		}
+		result = append(result, v.Window)
+	}
+	if cur != nil {
+		result = append(result, cur.Window)
+	}
+	return result
+}
+
+// refine splits a window with the splitter at the given level, until each
+// window holds at most MaxShardRecords records. Windows of unknown size are
+// split down to weekly windows. So are windows, that are not yet closed, since
+// their shards will be harvested again on subsequent runs.
+func (c CachingClient) refine(ctx context.Context, req Request, w Window, level int) ([]sizedWindow, error) {
+	closed := time.Now().Add(-c.Grace)
+	client := c.client()
+	var result []sizedWindow
+	for _, v := range splitters[level](w) {
+		r := req
+		r.From, r.Until = v.From, v.Until
+		size, known, err := probe(ctx, client, r)
+		if err != nil {
+			return nil, err
+		}
+		finer := level+1 < levels(req.Granularity)
+		open := v.Until.After(closed)
+		split := (known && size > c.MaxShardRecords && finer) || ((!known || open) && level < 2)
+		if !split {
+			result = append(result, sizedWindow{Window: v, size: size, known: known})
+			continue
+		}
+		ws, err := c.refine(ctx, req, v, level+1)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, ws...)
+	}
+	return result, nil
+}
+
+// adaptiveWindows returns the windows for a request. Windows, that have been
+// chosen by earlier runs, are reused. Uncovered time spans start as yearly
+// windows and get split into monthly, weekly, daily and, with second
+// granularity, hourly windows, as long as they hold more than MaxShardRecords
+// records. Adjacent sparse windows are
+// merged again. New windows are persisted under a lock, so that concurrent
+// requests do not choose overlapping windows. Windows may extend beyond the
+// request, see eachShard.
+func (c CachingClient) adaptiveWindows(ctx context.Context, req Request) ([]Window, error) {
+	prefix, err := shardPrefix(req)
+	if err != nil {
+		return nil, err
+	}
+	store := c.store()
+	windows, err := readLayout(store, prefix)
+	if err != nil {
+		return nil, err
+	}
+	span := Window{From: req.From, Until: req.Until}
+	if len(gaps(span, windows)) == 0 {
+		return overlapping(span, windows), nil
+	}
+	// another process might be filling the same gaps, so the layout is read
+	// again, once we hold the lock
+	if ls, ok := store.(lockingStore); ok {
+		unlock, err := ls.Lock(ctx, path.Join(prefix, LayoutFilename))
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+		if windows, err = readLayout(store, prefix); err != nil {
+			return nil, err
+		}
+	}
+	var added []Window
+	for _, gap := range gaps(span, windows) {
+		ws, err := c.refine(ctx, req, gap, 0)
+		if err != nil {
+			return nil, err
+		}
+		added = append(added, merge(ws, c.MaxShardRecords, time.Now().Add(-c.Grace))...)
+	}
+	if len(added) > 0 {
+		windows = append(windows, added...)
+		if err := writeLayout(store, prefix, windows); err != nil {
+			return nil, err
+		}
+	}
+	return overlapping(span, windows), nil
+}
@@ -0,0 +1,195 @@
+package oaimi
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miku/oaimi/oaitest"
+)
+
+func TestGaps(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2000, 1, d, 0, 0, 0, 0, time.UTC) }
+	eod := func(d int) time.Time { return day(d + 1).Add(-time.Nanosecond) }
+
+	var tests = []struct {
+		w       Window
+		windows []Window
+		gaps    []Window
+	}{
+		{
+			w:    Window{From: day(1), Until: eod(10)},
+			gaps: []Window{{From: day(1), Until: eod(10)}},
+		},
+		{
+			w:       Window{From: day(1), Until: eod(10)},
+			windows: []Window{{From: day(1), Until: eod(10)}},
+		},
+		{
+			w:       Window{From: day(1), Until: eod(10)},
+			windows: []Window{{From: day(3), Until: eod(4)}, {From: day(7), Until: eod(8)}},
+			gaps: []Window{
+				{From: day(1), Until: eod(2)},
+				{From: day(5), Until: eod(6)},
+				{From: day(9), Until: eod(10)},
+			},
+		},
+		{
+			w:       Window{From: day(5), Until: eod(6)},
+			windows: []Window{{From: day(1), Until: eod(5)}, {From: day(20), Until: eod(21)}},
+			gaps:    []Window{{From: day(6), Until: eod(6)}},
+		},
+	}
+	for _, test := range tests {
+		result := gaps(test.w, test.windows)
+		if !reflect.DeepEqual(result, test.gaps) {
+			t.Errorf("gaps() got %v, want %v", result, test.gaps)
+		}
+	}
+}
+
+func TestLayoutRoundtrip(t *testing.T) {
+	store := FileStore{Dir: t.TempDir()}
+	windows := Window{
+		From:  time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		Until: time.Date(2000, 3, 1, 0, 0, 0, 0, time.UTC),
+	}.Monthly()
+	if err := writeLayout(store, "example.com/ListRecords/oai_dc", windows); err != nil {
+		t.Fatal(err)
+	}
+	result, err := readLayout(store, "example.com/ListRecords/oai_dc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != len(windows) {
+		t.Fatalf("readLayout() got %d windows, want %d", len(result), len(windows))
+	}
+	for i := range result {
+		if !result[i].From.Equal(windows[i].From) || !result[i].Until.Equal(windows[i].Until) {
+			t.Errorf("readLayout() got %v, want %v", result[i], windows[i])
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2000, 1, d, 0, 0, 0, 0, time.UTC) }
+	eod := func(d int) time.Time { return day(d + 1).Add(-time.Nanosecond) }
+	sized := func(from, until, size int, known bool) sizedWindow {
+		return sizedWindow{Window: Window{From: day(from), Until: eod(until)}, size: size, known: known}
+	}
+	windows := []sizedWindow{
+		sized(1, 7, 3, true),
+		sized(8, 14, 0, true),
+		sized(15, 21, 9, true),
+		sized(22, 28, 1, false),
+		sized(29, 31, 0, true),
+		sized(32, 38, 0, true),
+	}
+	result := merge(windows, 10, eod(35))
+	want := []Window{
+		{From: day(1), Until: eod(14)},
+		{From: day(15), Until: eod(21)},
+		{From: day(22), Until: eod(28)},
+		{From: day(29), Until: eod(31)},
+		{From: day(32), Until: eod(38)},
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("merge() got %v, want %v", result, want)
+	}
+}
+
+func TestCachingClientAdaptive(t *testing.T) {
+	ts := oaitest.NewServer(oaitest.Config{Records: testRecords(20)})
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	c := NewCachingClientDir(&buf, t.TempDir())
+	c.Adaptive, c.MaxShardRecords = true, 10
+	req := Request{
+		Endpoint:    ts.URL,
+		Verb:        "ListRecords",
+		Prefix:      "oai_dc",
+		From:        time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		Until:       time.Date(2000, 12, 31, 0, 0, 0, 0, time.UTC),
+		Granularity: GranularityDay,
+	}
+	if err := c.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	prefix, _ := shardPrefix(req)
+	windows, err := readLayout(c.store(), prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the weeks of January hold 1, 7, 7, 5 and 0 records, the other months
+	// none, which is merged into three windows
+	if len(windows) != 3 {
+		t.Errorf("got %d windows, want 3: %v", len(windows), windows)
+	}
+
+	// windows of earlier runs extend beyond the request
+	buf.Reset()
+	req.From = time.Date(2000, 1, 5, 0, 0, 0, 0, time.UTC)
+	req.Until = time.Date(2000, 1, 10, 0, 0, 0, 0, time.UTC)
+	if err := c.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "<record>"); n != 6 {
+		t.Errorf("got %d records, want 6", n)
+	}
+	for _, id := range []string{"r4", "r9"} {
+		if !strings.Contains(buf.String(), "<identifier>"+id+"</identifier>") {
+			t.Errorf("missing %s", id)
+		}
+	}
+}
+
+func TestCachingClientAdaptiveHourly(t *testing.T) {
+	// a busy day, with records in three hours
+	var records []oaitest.Record
+	for i := 0; i < 12; i++ {
+		records = append(records, oaitest.Record{
+			Identifier: fmt.Sprintf("r%d", i),
+			Datestamp:  time.Date(2000, 1, 3, 8+i/4, i, 0, 0, time.UTC),
+		})
+	}
+	ts := oaitest.NewServer(oaitest.Config{Records: records, Granularity: oaitest.GranularitySecond})
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	c := NewCachingClientDir(&buf, t.TempDir())
+	c.Adaptive, c.MaxShardRecords = true, 5
+	req := Request{
+		Endpoint:    ts.URL,
+		Verb:        "ListRecords",
+		Prefix:      "oai_dc",
+		From:        time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		Until:       time.Date(2000, 1, 31, 23, 59, 59, 0, time.UTC),
+		Granularity: GranularitySecond,
+	}
+	if err := c.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "<record>"); n != 12 {
+		t.Errorf("got %d records, want 12", n)
+	}
+	prefix, _ := shardPrefix(req)
+	windows, err := readLayout(c.store(), prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range windows {
+		var n int
+		for _, r := range records {
+			if !r.Datestamp.Before(w.From) && !r.Datestamp.After(w.Until) {
+				n++
+			}
+		}
+		if n > c.MaxShardRecords {
+			t.Errorf("window %v holds %d records, want at most %d", w, n, c.MaxShardRecords)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+//  Copyright 2015 by Leipzig University Library, http://ub.uni-leipzig.de
+//                    The Finc Authors, http://finc.info
+//                    Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+//
+package oaimi
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHostLimiter is used by all clients, unless configured otherwise, so
+// limits and server requested pauses apply to all workers of a process.
+var DefaultHostLimiter = &HostLimiter{}
+
+// HostLimiter limits the rate and number of concurrent requests per host. A
+// zero HostLimiter imposes no limits, but still delays requests to hosts, that
+// asked for a pause with Retry-After. Limits should be set before first use.
+type HostLimiter struct {
+	// Rate is the number of requests per second per host, zero means no limit.
+	Rate float64
+	// Concurrency is the number of requests to a single host in flight at the
+	// same time, zero means no limit.
+	Concurrency int
+
+	mu    sync.Mutex
+	hosts map[string]*hostLimit
+}
+
+// hostLimit is the state of a single host.
+type hostLimit struct {
+	// next is the earliest time, the next request may start.
+	next time.Time
+	// slots limits concurrent requests, if not nil.
+	slots chan struct{}
+}
+
+// host returns the state of a host, creating it on first use.
+func (l *HostLimiter) host(name string) *hostLimit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.hosts == nil {
+		l.hosts = make(map[string]*hostLimit)
+	}
+	h, ok := l.hosts[name]
+	if !ok {
+		h = &hostLimit{}
+		if l.Concurrency > 0 {
+			h.slots = make(chan struct{}, l.Concurrency)
+		}
+		l.hosts[name] = h
+	}
+	return h
+}
+
+// Wait blocks, until a request to host may start. The returned function must
+// be called, once the request has finished.
+func (l *HostLimiter) Wait(ctx context.Context, host string) (release func(), err error) {
+	h := l.host(host)
+	release = func() {}
+	if h.slots != nil {
+		select {
+		case h.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		var once sync.Once
+		release = func() { once.Do(func() { <-h.slots }) }
+	}
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		wait := h.next.Sub(now)
+		if wait <= 0 {
+			if l.Rate > 0 {
+				h.next = now.Add(time.Duration(float64(time.Second) / l.Rate))
+			}
+			l.mu.Unlock()
+			return release, nil
+		}
+		l.mu.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			release()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Pause delays all requests to host until the given time.
+func (l *HostLimiter) Pause(host string, until time.Time) {
+	h := l.host(host)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until.After(h.next) {
+		h.next = until
+	}
+}
+
+// parseRetryAfter returns the duration to wait according to a Retry-After
+// header value, which is either a number of seconds or an HTTP-date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+// releaseBody releases a host limit, once the response body is closed.
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b releaseBody) Close() error {
+	defer b.release()
+	return b.ReadCloser.Close()
+}
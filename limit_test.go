@@ -0,0 +1,121 @@
+package oaimi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miku/oaimi/oaitest"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)
+	var tests = []struct {
+		value string
+		wait  time.Duration
+		ok    bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{" 0 ", 0, true},
+		{"Wed, 21 Oct 2015 07:30:00 GMT", 2 * time.Minute, true},
+		{"Wed, 21 Oct 2015 07:00:00 GMT", 0, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{"", 0, false},
+	}
+	for _, test := range tests {
+		wait, ok := parseRetryAfter(test.value, now)
+		if wait != test.wait || ok != test.ok {
+			t.Errorf("parseRetryAfter(%q) got %v, %v, want %v, %v", test.value, wait, ok, test.wait, test.ok)
+		}
+	}
+}
+
+func TestHostLimiter(t *testing.T) {
+	l := &HostLimiter{Rate: 20, Concurrency: 1}
+	ctx := context.Background()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		release, err := l.Wait(ctx, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("three requests at 20/s took %v, want at least 100ms", elapsed)
+	}
+
+	release, err := l.Wait(ctx, "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := l.Wait(ctx, "example.org"); err != context.DeadlineExceeded {
+		t.Errorf("Wait() on busy host got %v, want %v", err, context.DeadlineExceeded)
+	}
+	release()
+}
+
+func TestClientRetryAfter(t *testing.T) {
+	var tests = []struct {
+		unavailable int
+		requests    int
+		err         error
+	}{
+		{2, 3, nil},
+		{5, 3, ErrServiceUnavailable},
+	}
+	for _, test := range tests {
+		ts := oaitest.NewServer(oaitest.Config{Faults: oaitest.Faults{
+			Unavailable: test.unavailable,
+			RetryAfter:  "0",
+		}})
+		client := NewClientDoer(http.DefaultClient)
+		client.MaxRetries = 2
+		_, err := client.Do(Request{Endpoint: ts.URL, Verb: "Identify"})
+		if err != test.err {
+			t.Errorf("Do() got %v, want %v", err, test.err)
+		}
+		if ts.Requests() != test.requests {
+			t.Errorf("got %d requests, want %d", ts.Requests(), test.requests)
+		}
+		ts.Close()
+	}
+}
+
+func TestClientRetryServerError(t *testing.T) {
+	var mu sync.Mutex
+	var requests int
+	h := oaitest.NewHandler(oaitest.Config{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		n := requests
+		mu.Unlock()
+		switch n {
+		case 1:
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+		case 2:
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+		default:
+			h.ServeHTTP(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	client := NewClientDoer(http.DefaultClient)
+	client.MaxRetryAfter = 10 * time.Millisecond
+	if _, err := client.Do(Request{Endpoint: ts.URL, Verb: "Identify"}); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 3 {
+		t.Errorf("got %d requests, want 3", requests)
+	}
+}
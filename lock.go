@@ -0,0 +1,128 @@
+//  Copyright 2015 by Leipzig University Library, http://ub.uni-leipzig.de
+//                    The Finc Authors, http://finc.info
+//                    Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+//
+package oaimi
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// lockSuffix is appended to the filename of a key to get its lock file.
+const lockSuffix = ".lock"
+
+// LockPollInterval is the time between attempts to take a lock held by
+// another process.
+var LockPollInterval = 100 * time.Millisecond
+
+// lockingStore is implemented by stores, that can serialize the retrieval of
+// a key across processes, like FileStore. The returned function releases the
+// lock.
+type lockingStore interface {
+	Lock(ctx context.Context, key string) (unlock func() error, err error)
+}
+
+// warnUnlocked makes sure, that a store without locking is reported only once.
+var warnUnlocked sync.Once
+
+// checkLocking logs a warning, if a store cannot serialize retrievals across
+// processes, like S3Store. A KVStore is locked as a whole, see OpenKVStore.
+func checkLocking(store CacheStore) {
+	switch store.(type) {
+	case lockingStore, *KVStore:
+		return
+	}
+	warnUnlocked.Do(func() {
+		log.Printf("warning: %T does not lock shards, concurrent harvests may retrieve a shard twice", store)
+	})
+}
+
+// Lock takes an advisory lock on a key, in a lock file next to it, and waits
+// for other processes or clients holding it, until the context is done.
+func (s FileStore) Lock(ctx context.Context, key string) (func() error, error) {
+	filename := s.path(key) + lockSuffix
+	if err := mkdirAll(filepath.Dir(filename)); err != nil {
+		return nil, err
+	}
+	var waiting bool
+	for {
+		f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := tryLock(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		// the lock file may have been removed by gc, before we got the lock
+		if ok && sameFile(f, filename) {
+			return f.Close, nil
+		}
+		f.Close()
+		if !ok && Verbose && !waiting {
+			log.Printf("waiting for %s", filename)
+		}
+		waiting = !ok
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(LockPollInterval):
+		}
+	}
+}
+
+// sameFile reports whether an open file is still the one at filename.
+func sameFile(f *os.File, filename string) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	gi, err := os.Stat(filename)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fi, gi)
+}
+
+// removeLock removes a lock file, unless it is held.
+func removeLock(filename string) (bool, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	ok, err := tryLock(f)
+	if !ok || err != nil {
+		return false, err
+	}
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,45 @@
+//  Copyright 2015 by Leipzig University Library, http://ub.uni-leipzig.de
+//                    The Finc Authors, http://finc.info
+//                    Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+//
+
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package oaimi
+
+import (
+	"log"
+	"os"
+	"sync"
+)
+
+// warnLock makes sure, that the missing locking is reported only once.
+var warnLock sync.Once
+
+// tryLock always succeeds, advisory locks are not supported on this
+// platform. A warning is logged, since concurrent harvests may retrieve a
+// shard twice and a kv: store may be opened by several processes.
+func tryLock(f *os.File) (bool, error) {
+	warnLock.Do(func() {
+		log.Printf("warning: file locking is not supported on this platform, do not run several processes on the same cache")
+	})
+	return true, nil
+}
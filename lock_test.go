@@ -0,0 +1,132 @@
+package oaimi
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miku/oaimi/oaitest"
+)
+
+func TestFileStoreLock(t *testing.T) {
+	store := FileStore{Dir: t.TempDir()}
+	key := "example.com/oai/ListRecords/oai_dc/2000-01-01-2000-01-07.xml.gz"
+	unlock, err := store.Lock(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*LockPollInterval)
+	defer cancel()
+	if _, err := store.Lock(ctx, key); err != context.DeadlineExceeded {
+		t.Errorf("Lock() of held lock got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if removed, err := removeLock(store.path(key) + lockSuffix); removed || err != nil {
+		t.Errorf("removeLock() of held lock got %v, %v", removed, err)
+	}
+	if err := unlock(); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err = store.Lock(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Lock() after unlock got %v", err)
+	}
+	unlock()
+	if keys, _ := store.List(""); len(keys) != 0 {
+		t.Errorf("List() got lock files %v", keys)
+	}
+}
+
+func TestCachingClientConcurrent(t *testing.T) {
+	ts := oaitest.NewServer(oaitest.Config{
+		Records:  testRecords(20),
+		PageSize: 4,
+		Faults:   oaitest.Faults{Latency: 10 * time.Millisecond},
+	})
+	defer ts.Close()
+
+	req := Request{
+		Endpoint:    ts.URL,
+		Verb:        "ListRecords",
+		Prefix:      "oai_dc",
+		From:        time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		Until:       time.Date(2000, 1, 31, 0, 0, 0, 0, time.UTC),
+		Granularity: GranularityDay,
+	}
+	if err := NewCachingClientDir(ioutil.Discard, t.TempDir()).Do(req); err != nil {
+		t.Fatal(err)
+	}
+	single := ts.Requests()
+
+	// clients sharing a cache dir behave like separate processes, since each
+	// lock is taken on a file of its own
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = NewCachingClientDir(ioutil.Discard, dir).Do(req)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := ts.Requests() - single; n != single {
+		t.Errorf("concurrent harvests got %d requests, want %d", n, single)
+	}
+}
+
+func TestCachingClientConcurrentAdaptive(t *testing.T) {
+	ts := oaitest.NewServer(oaitest.Config{
+		Records: testRecords(20),
+		Faults:  oaitest.Faults{Latency: 10 * time.Millisecond},
+	})
+	defer ts.Close()
+
+	// overlapping requests must not lose or duplicate each others windows
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := NewCachingClientDir(ioutil.Discard, dir)
+			c.Adaptive, c.MaxShardRecords = true, 10
+			errs[i] = c.Do(Request{
+				Endpoint:    ts.URL,
+				Verb:        "ListRecords",
+				Prefix:      "oai_dc",
+				From:        time.Date(2000, time.Month(1+3*i), 1, 0, 0, 0, 0, time.UTC),
+				Until:       time.Date(2000, time.Month(6+3*i), 1, 0, 0, 0, 0, time.UTC).Add(-time.Second),
+				Granularity: GranularityDay,
+			})
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	prefix, _ := shardPrefix(Request{Endpoint: ts.URL, Verb: "ListRecords", Prefix: "oai_dc"})
+	windows, err := readLayout(FileStore{Dir: dir}, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(windows); i++ {
+		if !windows[i].From.After(windows[i-1].Until) {
+			t.Errorf("overlapping windows %v and %v", windows[i-1], windows[i])
+		}
+	}
+	year := Window{From: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), Until: time.Date(2000, 12, 31, 23, 59, 59, 0, time.UTC)}
+	if g := gaps(year, windows); len(g) > 0 {
+		t.Errorf("got gaps %v in layout %v", g, windows)
+	}
+}
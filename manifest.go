@@ -0,0 +1,260 @@
+//  Copyright 2015 by Leipzig University Library, http://ub.uni-leipzig.de
+//                    The Finc Authors, http://finc.info
+//                    Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+//
+package oaimi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ManifestFilename is the name of the file next to the shards of a request,
+// that describes the retrieval of each shard.
+const ManifestFilename = "manifest.json"
+
+// ShardInfo describes the last retrieval of a shard.
+type ShardInfo struct {
+	// Name is the name of the shard, e.g. 2015-01-01-2015-01-07.xml.gz.
+	Name  string    `json:"name"`
+	From  time.Time `json:"from"`
+	Until time.Time `json:"until"`
+	// Attempted is the time of the last retrieval, Fetched the time of the
+	// last successful one.
+	Attempted time.Time `json:"attempted"`
+	Fetched   time.Time `json:"fetched"`
+	// Version of oaimi, that retrieved the shard.
+	Version string `json:"version"`
+	Records int    `json:"records"`
+	Pages   int    `json:"pages"`
+	// Size and SHA256 refer to the uncompressed shard.
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	// Status is the HTTP status of the last response.
+	Status         int  `json:"status,omitempty"`
+	NoRecordsMatch bool `json:"noRecordsMatch,omitempty"`
+	// Error of the last retrieval, if it failed. A previous version of the
+	// shard is kept in that case.
+	Error string `json:"error,omitempty"`
+}
+
+// OK reports whether the last retrieval succeeded.
+func (si ShardInfo) OK() bool {
+	return si.Error == ""
+}
+
+// Manifest describes the shards of a request, without from and until. The
+// granularity is the one used for from and until in the shard requests.
+type Manifest struct {
+	Endpoint    string      `json:"endpoint"`
+	Verb        string      `json:"verb"`
+	Prefix      string      `json:"prefix"`
+	Set         string      `json:"set,omitempty"`
+	Granularity string      `json:"granularity,omitempty"`
+	Shards      []ShardInfo `json:"shards"`
+}
+
+// update records the retrievals of shards. A failed retrieval keeps the
+// information about an earlier successful one.
+func (m *Manifest) update(infos []ShardInfo) {
+	byName := make(map[string]int)
+	for i, si := range m.Shards {
+		byName[si.Name] = i
+	}
+	for _, si := range infos {
+		i, ok := byName[si.Name]
+		switch {
+		case !ok:
+			byName[si.Name] = len(m.Shards)
+			m.Shards = append(m.Shards, si)
+		case !si.OK():
+			prev := &m.Shards[i]
+			prev.Attempted, prev.Status, prev.Error = si.Attempted, si.Status, si.Error
+		default:
+			m.Shards[i] = si
+		}
+	}
+	sort.Slice(m.Shards, func(i, j int) bool { return m.Shards[i].Name < m.Shards[j].Name })
+}
+
+// find returns the entry of a shard.
+func (m Manifest) find(name string) (ShardInfo, bool) {
+	for _, si := range m.Shards {
+		if si.Name == name {
+			return si, true
+		}
+	}
+	return ShardInfo{}, false
+}
+
+// ReadManifest reads the manifest of the shards below a store prefix. A
+// missing manifest results in an empty one.
+func ReadManifest(store CacheStore, prefix string) (Manifest, error) {
+	var m Manifest
+	rc, err := store.Open(path.Join(prefix, ManifestFilename))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+	defer rc.Close()
+	err = json.NewDecoder(rc).Decode(&m)
+	return m, err
+}
+
+// writeManifest persists a manifest next to the shards.
+func writeManifest(store CacheStore, prefix string, m Manifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	w, err := store.Create(path.Join(prefix, ManifestFilename))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// updateManifest records shard retrievals in the manifest of a request.
+func updateManifest(store CacheStore, req Request, infos []ShardInfo) error {
+	if len(infos) == 0 {
+		return nil
+	}
+	prefix, err := shardPrefix(req)
+	if err != nil {
+		return err
+	}
+	if ls, ok := store.(lockingStore); ok {
+		unlock, err := ls.Lock(context.Background(), path.Join(prefix, ManifestFilename))
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	m, err := ReadManifest(store, prefix)
+	if err != nil {
+		return err
+	}
+	m.Endpoint, m.Verb, m.Prefix, m.Set = req.Endpoint, req.Verb, req.Prefix, req.Set
+	m.Granularity = req.Granularity
+	m.update(infos)
+	return writeManifest(store, prefix, m)
+}
+
+// shardStats reads a shard completely and returns its uncompressed size,
+// checksum and number of records or headers.
+func shardStats(store CacheStore, key string) (size int64, sum string, records int, err error) {
+	rc, err := store.Open(key)
+	if err != nil {
+		return 0, "", 0, err
+	}
+	defer rc.Close()
+	return readShard(rc)
+}
+
+// readShard reads a shard to the end and returns its size, checksum and
+// number of records or headers. Fails on malformed XML and on errors other
+// than noRecordsMatch in the responses.
+func readShard(rc io.Reader) (size int64, sum string, records int, err error) {
+	h := sha256.New()
+	cw := &countingWriter{}
+	r := io.TeeReader(rc, io.MultiWriter(h, cw))
+	rr := newRecordReader(r)
+	var rec Record
+	for {
+		err := rr.next(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err == errNoRecordsMatch {
+			continue
+		}
+		if err != nil {
+			return cw.n, "", records, err
+		}
+		records++
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return cw.n, "", records, err
+	}
+	return cw.n, hex.EncodeToString(h.Sum(nil)), records, nil
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// CachedShard is a shard in a store, together with its manifest entry.
+type CachedShard struct {
+	Key string `json:"key"`
+	// Info is nil, if the shard is not recorded in a manifest, e.g. because
+	// it has been retrieved by an older version of oaimi.
+	Info *ShardInfo `json:"info"`
+}
+
+// ListShards returns the shards below a prefix, like the one returned by
+// EndpointPrefix, with their manifest entries.
+func ListShards(store CacheStore, prefix string) ([]CachedShard, error) {
+	keys, err := store.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	manifests := make(map[string]Manifest)
+	var shards []CachedShard
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".xml.gz") {
+			continue
+		}
+		dir := path.Dir(key)
+		m, ok := manifests[dir]
+		if !ok {
+			if m, err = ReadManifest(store, dir); err != nil {
+				return nil, err
+			}
+			manifests[dir] = m
+		}
+		shard := CachedShard{Key: key}
+		if si, ok := m.find(path.Base(key)); ok {
+			shard.Info = &si
+		}
+		shards = append(shards, shard)
+	}
+	return shards, nil
+}
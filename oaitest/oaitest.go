@@ -0,0 +1,532 @@
+//  Copyright 2015 by Leipzig University Library, http://ub.uni-leipzig.de
+//                    The Finc Authors, http://finc.info
+//                    Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+//
+
+// Package oaitest provides a configurable OAI-PMH repository for harvesting
+// tests. It serves a fixed list of records and can simulate common faults of
+// real world repositories.
+//
+//     ts := oaitest.NewServer(oaitest.Config{
+//         Records:  []oaitest.Record{{Identifier: "a", Datestamp: t}},
+//         PageSize: 10,
+//     })
+//     defer ts.Close()
+//     req := oaimi.Request{Endpoint: ts.URL, Verb: "ListRecords", Prefix: "oai_dc"}
+//
+// The package does not depend on oaimi, so it can be used in its tests, too.
+package oaitest
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// GranularityDay is the default datestamp granularity.
+	GranularityDay = "YYYY-MM-DD"
+	// GranularitySecond allows datestamps with seconds.
+	GranularitySecond = "YYYY-MM-DDThh:mm:ssZ"
+)
+
+// Record is an item of the repository, available in every metadata format.
+type Record struct {
+	Identifier string
+	Datestamp  time.Time
+	Sets       []string
+	Deleted    bool
+	// Metadata is the raw XML content of the metadata element. If empty, a
+	// small Dublin Core record with the identifier as title is used.
+	Metadata string
+}
+
+// Set describes a set of the repository.
+type Set struct {
+	Spec string
+	Name string
+}
+
+// Format describes a metadata format of the repository.
+type Format struct {
+	Prefix    string
+	Schema    string
+	Namespace string
+}
+
+// Faults are deviations from the protocol, that the server simulates.
+type Faults struct {
+	// BadResumptionToken answers every request with a resumption token with
+	// a badResumptionToken error.
+	BadResumptionToken bool
+	// Unavailable is the number of requests answered with 503 Service
+	// Unavailable, before regular responses are sent.
+	Unavailable int
+	// RetryAfter is the value of the Retry-After header of 503 responses,
+	// either seconds or an HTTP-date. Defaults to "1".
+	RetryAfter string
+	// MalformedPage is the page of a list request sequence, counting from 1,
+	// whose response is cut off in the middle of a record. Zero means none.
+	MalformedPage int
+	// EndlessTokens returns the last page of a list over and over again, with
+	// the same non-empty resumption token.
+	EndlessTokens bool
+	// Latency delays every response, e.g. to let concurrent harvests overlap.
+	Latency time.Duration
+}
+
+// Config describes the repository.
+type Config struct {
+	// Name of the repository, defaults to "oaitest".
+	Name string
+	// Records in any order, they are served ordered by datestamp.
+	Records []Record
+	Sets    []Set
+	// Formats defaults to oai_dc.
+	Formats []Format
+	// Granularity defaults to GranularityDay.
+	Granularity string
+	// PageSize is the number of items per list response, defaults to 100.
+	PageSize int
+	Faults   Faults
+}
+
+// Server is a running test repository.
+type Server struct {
+	*httptest.Server
+	handler *Handler
+}
+
+// NewServer starts a test repository. The caller should call Close.
+func NewServer(config Config) *Server {
+	h := NewHandler(config)
+	return &Server{Server: httptest.NewServer(h), handler: h}
+}
+
+// Requests returns the number of HTTP requests served so far.
+func (s *Server) Requests() int {
+	return s.handler.Requests()
+}
+
+// Handler answers OAI-PMH requests for a configuration.
+type Handler struct {
+	config Config
+	// records sorted by datestamp
+	records []Record
+
+	mu       sync.Mutex
+	requests int
+}
+
+// NewHandler returns a handler for a configuration, with defaults filled in.
+func NewHandler(config Config) *Handler {
+	if config.Name == "" {
+		config.Name = "oaitest"
+	}
+	if len(config.Formats) == 0 {
+		config.Formats = []Format{{
+			Prefix:    "oai_dc",
+			Schema:    "http://www.openarchives.org/OAI/2.0/oai_dc.xsd",
+			Namespace: "http://www.openarchives.org/OAI/2.0/oai_dc/",
+		}}
+	}
+	if config.Granularity == "" {
+		config.Granularity = GranularityDay
+	}
+	if config.PageSize <= 0 {
+		config.PageSize = 100
+	}
+	if config.Faults.RetryAfter == "" {
+		config.Faults.RetryAfter = "1"
+	}
+	records := append([]Record{}, config.Records...)
+	// insertion sort keeps records with equal datestamps in given order
+	for i := 1; i < len(records); i++ {
+		for j := i; j > 0 && records[j].Datestamp.Before(records[j-1].Datestamp); j-- {
+			records[j], records[j-1] = records[j-1], records[j]
+		}
+	}
+	return &Handler{config: config, records: records}
+}
+
+// Requests returns the number of HTTP requests served so far.
+func (h *Handler) Requests() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.requests
+}
+
+// oaiError is an OAI-PMH error condition.
+type oaiError struct {
+	code, message string
+}
+
+// ServeHTTP answers a single request.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.requests++
+	n := h.requests
+	h.mu.Unlock()
+
+	time.Sleep(h.config.Faults.Latency)
+	if n <= h.config.Faults.Unavailable {
+		w.Header().Set("Retry-After", h.config.Faults.RetryAfter)
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var body bytes.Buffer
+	args := r.Form
+	page, err := h.answer(&body, args, h.baseURL(r))
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>`+"\n")
+	fmt.Fprintf(w, `<OAI-PMH xmlns="http://www.openarchives.org/OAI/2.0/" `+
+		`xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" `+
+		`xsi:schemaLocation="http://www.openarchives.org/OAI/2.0/ http://www.openarchives.org/OAI/2.0/OAI-PMH.xsd">`)
+	fmt.Fprintf(w, `<responseDate>%s</responseDate>`, time.Now().UTC().Format("2006-01-02T15:04:05Z"))
+	if err != nil && (err.code == "badVerb" || err.code == "badArgument") {
+		fmt.Fprintf(w, `<request>%s</request>`, escape(h.baseURL(r)))
+	} else {
+		fmt.Fprint(w, `<request`)
+		for _, k := range []string{"verb", "identifier", "metadataPrefix", "from", "until", "set", "resumptionToken"} {
+			if v := args.Get(k); v != "" {
+				fmt.Fprintf(w, ` %s="%s"`, k, escape(v))
+			}
+		}
+		fmt.Fprintf(w, `>%s</request>`, escape(h.baseURL(r)))
+	}
+	if err != nil {
+		fmt.Fprintf(w, `<error code="%s">%s</error></OAI-PMH>`, err.code, escape(err.message))
+		return
+	}
+	if page > 0 && page == h.config.Faults.MalformedPage {
+		w.Write(body.Bytes()[:body.Len()/2])
+		return
+	}
+	body.WriteTo(w)
+	io.WriteString(w, `</OAI-PMH>`)
+}
+
+// baseURL returns the URL of the repository.
+func (h *Handler) baseURL(r *http.Request) string {
+	return "http://" + r.Host + r.URL.Path
+}
+
+// answer writes the verb element for a request and returns the page number for
+// list requests.
+func (h *Handler) answer(w io.Writer, args url.Values, baseURL string) (int, *oaiError) {
+	for k, vs := range args {
+		if len(vs) > 1 {
+			if k == "verb" {
+				return 0, &oaiError{"badVerb", "repeated verb"}
+			}
+			return 0, &oaiError{"badArgument", "repeated argument: " + k}
+		}
+	}
+	if err := checkArguments(args); err != nil {
+		return 0, err
+	}
+	switch args.Get("verb") {
+	case "Identify":
+		earliest := time.Time{}
+		if len(h.records) > 0 {
+			earliest = h.records[0].Datestamp
+		}
+		fmt.Fprintf(w, `<Identify><repositoryName>%s</repositoryName><baseURL>%s</baseURL>`+
+			`<protocolVersion>2.0</protocolVersion><adminEmail>oaitest@localhost</adminEmail>`+
+			`<earliestDatestamp>%s</earliestDatestamp><deletedRecord>persistent</deletedRecord>`+
+			`<granularity>%s</granularity></Identify>`,
+			escape(h.config.Name), escape(baseURL), h.format(earliest), h.config.Granularity)
+	case "ListMetadataFormats":
+		if id := args.Get("identifier"); id != "" && h.find(id) < 0 {
+			return 0, &oaiError{"idDoesNotExist", "no such identifier: " + id}
+		}
+		io.WriteString(w, `<ListMetadataFormats>`)
+		for _, f := range h.config.Formats {
+			fmt.Fprintf(w, `<metadataFormat><metadataPrefix>%s</metadataPrefix><schema>%s</schema>`+
+				`<metadataNamespace>%s</metadataNamespace></metadataFormat>`,
+				escape(f.Prefix), escape(f.Schema), escape(f.Namespace))
+		}
+		io.WriteString(w, `</ListMetadataFormats>`)
+	case "ListSets":
+		if len(h.config.Sets) == 0 {
+			return 0, &oaiError{"noSetHierarchy", "no sets"}
+		}
+		io.WriteString(w, `<ListSets>`)
+		for _, s := range h.config.Sets {
+			fmt.Fprintf(w, `<set><setSpec>%s</setSpec><setName>%s</setName></set>`, escape(s.Spec), escape(s.Name))
+		}
+		io.WriteString(w, `</ListSets>`)
+	case "GetRecord":
+		if !h.hasFormat(args.Get("metadataPrefix")) {
+			return 0, &oaiError{"cannotDisseminateFormat", "no such format: " + args.Get("metadataPrefix")}
+		}
+		i := h.find(args.Get("identifier"))
+		if i < 0 {
+			return 0, &oaiError{"idDoesNotExist", "no such identifier: " + args.Get("identifier")}
+		}
+		io.WriteString(w, `<GetRecord>`)
+		h.writeRecord(w, h.records[i])
+		io.WriteString(w, `</GetRecord>`)
+	case "ListIdentifiers", "ListRecords":
+		return h.list(w, args)
+	default:
+		return 0, &oaiError{"badVerb", "illegal verb"}
+	}
+	return 0, nil
+}
+
+// arguments lists required (true) and optional (false) arguments per verb.
+// The resumptionToken is exclusive.
+var arguments = map[string]map[string]bool{
+	"Identify":            {},
+	"ListMetadataFormats": {"identifier": false},
+	"ListSets":            {"resumptionToken": false},
+	"GetRecord":           {"identifier": true, "metadataPrefix": true},
+	"ListIdentifiers": {"metadataPrefix": true, "from": false, "until": false,
+		"set": false, "resumptionToken": false},
+	"ListRecords": {"metadataPrefix": true, "from": false, "until": false,
+		"set": false, "resumptionToken": false},
+}
+
+// checkArguments reports illegal, missing and non-exclusive arguments of a
+// known verb.
+func checkArguments(args url.Values) *oaiError {
+	allowed, ok := arguments[args.Get("verb")]
+	if !ok {
+		return nil
+	}
+	for k := range args {
+		if _, ok := allowed[k]; !ok && k != "verb" {
+			return &oaiError{"badArgument", "illegal argument: " + k}
+		}
+	}
+	if _, ok := args["resumptionToken"]; ok {
+		if len(args) > 2 {
+			return &oaiError{"badArgument", "resumptionToken is an exclusive argument"}
+		}
+		return nil
+	}
+	for k, required := range allowed {
+		if _, ok := args[k]; required && !ok {
+			return &oaiError{"badArgument", "missing argument: " + k}
+		}
+	}
+	return nil
+}
+
+// list answers ListIdentifiers and ListRecords. The resumption token carries
+// the original arguments, the offset and the page number.
+func (h *Handler) list(w io.Writer, args url.Values) (int, *oaiError) {
+	verb := args.Get("verb")
+	offset, page := 0, 1
+	if token := args.Get("resumptionToken"); token != "" {
+		if h.config.Faults.BadResumptionToken {
+			return 0, &oaiError{"badResumptionToken", "token expired"}
+		}
+		state, err := url.ParseQuery(token)
+		if err != nil {
+			return 0, &oaiError{"badResumptionToken", "invalid token"}
+		}
+		if offset, err = strconv.Atoi(state.Get("offset")); err != nil {
+			return 0, &oaiError{"badResumptionToken", "invalid token"}
+		}
+		if page, err = strconv.Atoi(state.Get("page")); err != nil {
+			return 0, &oaiError{"badResumptionToken", "invalid token"}
+		}
+		args = state
+	}
+	if !h.hasFormat(args.Get("metadataPrefix")) {
+		return 0, &oaiError{"cannotDisseminateFormat", "no such format: " + args.Get("metadataPrefix")}
+	}
+	from, err := h.parse(args.Get("from"), false)
+	if err != nil {
+		return 0, &oaiError{"badArgument", "invalid from"}
+	}
+	until, err := h.parse(args.Get("until"), true)
+	if err != nil {
+		return 0, &oaiError{"badArgument", "invalid until"}
+	}
+	set := args.Get("set")
+	if set != "" && len(h.config.Sets) == 0 {
+		return 0, &oaiError{"noSetHierarchy", "no sets"}
+	}
+	var matches []Record
+	for _, rec := range h.records {
+		if !from.IsZero() && rec.Datestamp.Before(from) {
+			continue
+		}
+		if !until.IsZero() && rec.Datestamp.After(until) {
+			continue
+		}
+		if set != "" && !inSet(rec, set) {
+			continue
+		}
+		matches = append(matches, rec)
+	}
+	if len(matches) == 0 {
+		return 0, &oaiError{"noRecordsMatch", "no records match"}
+	}
+	if offset > len(matches) {
+		return 0, &oaiError{"badResumptionToken", "invalid offset"}
+	}
+	end := offset + h.config.PageSize
+	if end > len(matches) {
+		end = len(matches)
+	}
+	fmt.Fprintf(w, `<%s>`, verb)
+	for _, rec := range matches[offset:end] {
+		if verb == "ListIdentifiers" {
+			h.writeHeader(w, rec)
+		} else {
+			h.writeRecord(w, rec)
+		}
+	}
+	var token string
+	switch {
+	case end < len(matches):
+		token = h.token(args, end, page+1)
+	case h.config.Faults.EndlessTokens:
+		token = h.token(args, offset, page+1)
+	}
+	if token != "" || offset > 0 {
+		fmt.Fprintf(w, `<resumptionToken completeListSize="%d" cursor="%d">%s</resumptionToken>`,
+			len(matches), offset, escape(token))
+	}
+	fmt.Fprintf(w, `</%s>`, verb)
+	return page, nil
+}
+
+// token returns a resumption token for the next page.
+func (h *Handler) token(args url.Values, offset, page int) string {
+	state := url.Values{}
+	for _, k := range []string{"verb", "metadataPrefix", "from", "until", "set"} {
+		if v := args.Get(k); v != "" {
+			state.Set(k, v)
+		}
+	}
+	state.Set("offset", strconv.Itoa(offset))
+	state.Set("page", strconv.Itoa(page))
+	return state.Encode()
+}
+
+// parse parses a from or until argument in the granularity of the
+// repository. An until date includes the whole day.
+func (h *Handler) parse(s string, until bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if len(s) == len("2006-01-02") {
+		t, err := time.Parse("2006-01-02", s)
+		if until {
+			t = t.Add(24*time.Hour - time.Nanosecond)
+		}
+		return t, err
+	}
+	if h.config.Granularity != GranularitySecond {
+		return time.Time{}, fmt.Errorf("granularity not supported")
+	}
+	return time.Parse("2006-01-02T15:04:05Z", s)
+}
+
+// format formats a datestamp in the granularity of the repository.
+func (h *Handler) format(t time.Time) string {
+	if h.config.Granularity == GranularitySecond {
+		return t.UTC().Format("2006-01-02T15:04:05Z")
+	}
+	return t.UTC().Format("2006-01-02")
+}
+
+// find returns the index of a record or -1.
+func (h *Handler) find(identifier string) int {
+	for i, rec := range h.records {
+		if rec.Identifier == identifier {
+			return i
+		}
+	}
+	return -1
+}
+
+// hasFormat reports whether a metadata prefix is supported.
+func (h *Handler) hasFormat(prefix string) bool {
+	for _, f := range h.config.Formats {
+		if f.Prefix == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// inSet reports whether a record belongs to a set or one of its subsets.
+func inSet(rec Record, spec string) bool {
+	for _, s := range rec.Sets {
+		if s == spec || strings.HasPrefix(s, spec+":") {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Handler) writeHeader(w io.Writer, rec Record) {
+	if rec.Deleted {
+		io.WriteString(w, `<header status="deleted">`)
+	} else {
+		io.WriteString(w, `<header>`)
+	}
+	fmt.Fprintf(w, `<identifier>%s</identifier><datestamp>%s</datestamp>`,
+		escape(rec.Identifier), h.format(rec.Datestamp))
+	for _, s := range rec.Sets {
+		fmt.Fprintf(w, `<setSpec>%s</setSpec>`, escape(s))
+	}
+	io.WriteString(w, `</header>`)
+}
+
+func (h *Handler) writeRecord(w io.Writer, rec Record) {
+	io.WriteString(w, `<record>`)
+	h.writeHeader(w, rec)
+	if !rec.Deleted {
+		metadata := rec.Metadata
+		if metadata == "" {
+			metadata = `<oai_dc:dc xmlns:oai_dc="http://www.openarchives.org/OAI/2.0/oai_dc/" ` +
+				`xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:title>` +
+				escape(rec.Identifier) + `</dc:title></oai_dc:dc>`
+		}
+		fmt.Fprintf(w, `<metadata>%s</metadata>`, metadata)
+	}
+	io.WriteString(w, `</record>`)
+}
+
+// escape escapes text for use in XML.
+func escape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
@@ -0,0 +1,85 @@
+package oaitest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerPages(t *testing.T) {
+	var records []Record
+	for i := 0; i < 5; i++ {
+		records = append(records, Record{
+			Identifier: fmt.Sprintf("r%d", i),
+			Datestamp:  time.Date(2000, 1, 5-i, 0, 0, 0, 0, time.UTC),
+			Sets:       []string{"a:b"},
+		})
+	}
+	ts := NewServer(Config{Records: records, PageSize: 2, Sets: []Set{{Spec: "a", Name: "A"}}})
+	defer ts.Close()
+
+	var ids []string
+	query := "verb=ListIdentifiers&metadataPrefix=oai_dc&set=a&from=2000-01-02"
+	for {
+		resp, err := http.Get(ts.URL + "?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var page struct {
+			Identifiers []string `xml:"ListIdentifiers>header>identifier"`
+			Token       string   `xml:"ListIdentifiers>resumptionToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, page.Identifiers...)
+		if page.Token == "" {
+			break
+		}
+		query = "verb=ListIdentifiers&resumptionToken=" + url.QueryEscape(page.Token)
+	}
+	if got, want := strings.Join(ids, " "), "r3 r2 r1 r0"; got != want {
+		t.Errorf("identifiers got %v, want %v", got, want)
+	}
+	if ts.Requests() != 2 {
+		t.Errorf("got %d requests, want 2", ts.Requests())
+	}
+}
+
+func TestServerFaults(t *testing.T) {
+	ts := NewServer(Config{
+		Records:  []Record{{Identifier: "a"}, {Identifier: "b"}},
+		PageSize: 1,
+		Faults:   Faults{Unavailable: 1, RetryAfter: "3", MalformedPage: 1},
+	})
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "?verb=ListRecords&metadataPrefix=oai_dc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "3" {
+		t.Errorf("got %d, Retry-After %q, want 503, 3", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	resp, err = http.Get(ts.URL + "?verb=ListRecords&metadataPrefix=oai_dc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v interface{}
+	if err := xml.Unmarshal(b, &v); err == nil {
+		t.Errorf("got well-formed response, want malformed")
+	}
+}
@@ -0,0 +1,129 @@
+//  Copyright 2015 by Leipzig University Library, http://ub.uni-leipzig.de
+//                    The Finc Authors, http://finc.info
+//                    Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+//
+package oaimi
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+)
+
+// Output formats for records.
+const (
+	// FormatXML writes the raw responses or, for snapshots, record elements.
+	FormatXML = "xml"
+	// FormatJSONL writes one JSON object per record and line.
+	FormatJSONL = "jsonl"
+	// FormatTSV writes identifier, datestamp and status of each record as
+	// tab separated values, e.g. for comparing lists of identifiers.
+	FormatTSV = "tsv"
+)
+
+// ErrBadFormat is returned for unknown output formats.
+var ErrBadFormat = errors.New("bad format")
+
+// JSONRecord is the JSON representation of a single record.
+type JSONRecord struct {
+	Identifier string   `json:"identifier"`
+	Datestamp  string   `json:"datestamp"`
+	SetSpecs   []string `json:"setSpecs,omitempty"`
+	Deleted    bool     `json:"deleted"`
+	Endpoint   string   `json:"endpoint"`
+	Prefix     string   `json:"prefix,omitempty"`
+	// Metadata is the verbatim content of the metadata element.
+	Metadata string `json:"metadata,omitempty"`
+	// About holds the verbatim content of the about containers.
+	About []string `json:"about,omitempty"`
+	// Provenance and Rights are parsed from the about containers.
+	Provenance []Origin `json:"provenance,omitempty"`
+	Rights     []string `json:"rights,omitempty"`
+}
+
+// NewJSONRecord converts a record, that has been retrieved with a given
+// request.
+func NewJSONRecord(req Request, rec Record) JSONRecord {
+	jr := JSONRecord{
+		Identifier: rec.Header.Identifier,
+		Datestamp:  rec.Header.Datestamp,
+		SetSpecs:   rec.Header.SetSpec,
+		Deleted:    rec.Header.Deleted(),
+		Endpoint:   req.Endpoint,
+		Prefix:     req.Prefix,
+		Metadata:   rec.Metadata.Verbatim,
+		Provenance: rec.Origins(),
+		Rights:     rec.RightsReferences(),
+	}
+	for _, a := range rec.About {
+		jr.About = append(jr.About, a.Verbatim)
+	}
+	return jr
+}
+
+// recordWriter returns a function, that writes a single record of a given
+// request to the client writer, in the format of the client. Records without
+// a matching about container are skipped, if the client has an About filter.
+func (c CachingClient) recordWriter(req Request) (func(Record) error, error) {
+	write, err := c.formatWriter(req)
+	if err != nil || c.About == "" {
+		return write, err
+	}
+	return func(rec Record) error {
+		if !rec.HasAbout(c.About) {
+			return nil
+		}
+		return write(rec)
+	}, nil
+}
+
+// formatWriter returns a function, that writes a single record in the format
+// of the client.
+func (c CachingClient) formatWriter(req Request) (func(Record) error, error) {
+	switch c.Format {
+	case "", FormatXML:
+		return func(rec Record) error {
+			var v interface{} = rec
+			if req.Verb == "ListIdentifiers" {
+				v = rec.Header
+			}
+			b, err := xml.Marshal(v)
+			if err != nil {
+				return err
+			}
+			_, err = c.w.Write(b)
+			return err
+		}, nil
+	case FormatJSONL:
+		enc := json.NewEncoder(c.w)
+		enc.SetEscapeHTML(false)
+		return func(rec Record) error {
+			return enc.Encode(NewJSONRecord(req, rec))
+		}, nil
+	case FormatTSV:
+		return func(rec Record) error {
+			_, err := fmt.Fprintf(c.w, "%s\t%s\t%s\n", rec.Header.Identifier,
+				rec.Header.Datestamp, rec.Header.Status)
+			return err
+		}, nil
+	}
+	return nil, ErrBadFormat
+}
@@ -0,0 +1,96 @@
+package oaimi
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRecordWriter(t *testing.T) {
+	var rec Record
+	rec.Header.Identifier = "x"
+	rec.Header.Datestamp = "2000-01-01"
+	rec.Header.SetSpec = []string{"a:b"}
+	rec.Metadata.Verbatim = `<dc id="1">&amp;</dc>`
+	req := Request{Endpoint: "http://example.com/oai", Verb: "ListRecords", Prefix: "oai_dc"}
+
+	var tests = []struct {
+		format string
+		out    string
+		err    error
+	}{
+		{FormatJSONL, `{"identifier":"x","datestamp":"2000-01-01","setSpecs":["a:b"],"deleted":false,` +
+			`"endpoint":"http://example.com/oai","prefix":"oai_dc","metadata":"<dc id=\"1\">&amp;</dc>"}` + "\n", nil},
+		{FormatXML, `<record><header><identifier>x</identifier><datestamp>2000-01-01</datestamp>` +
+			`<setSpec>a:b</setSpec></header><metadata><dc id="1">&amp;</dc></metadata></record>`, nil},
+		{FormatTSV, "x\t2000-01-01\t\n", nil},
+		{"yaml", "", ErrBadFormat},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		c := NewCachingClientDir(&buf, t.TempDir())
+		c.Format = test.format
+		write, err := c.recordWriter(req)
+		if err != test.err {
+			t.Errorf("recordWriter() got %v, want %v", err, test.err)
+		}
+		if err != nil {
+			continue
+		}
+		if err := write(rec); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.out {
+			t.Errorf("write() got %v, want %v", buf.String(), test.out)
+		}
+	}
+}
+
+func TestRecordAbout(t *testing.T) {
+	body := `<record><header><identifier>x</identifier><datestamp>2000-01-01</datestamp></header>` +
+		`<metadata><dc/></metadata>` +
+		`<about><provenance xmlns="http://www.openarchives.org/OAI/2.0/provenance">` +
+		`<originDescription harvestDate="2002-02-02T14:10:02Z" altered="true">` +
+		`<baseURL>http://a.example.org/oai</baseURL><identifier>oai:a:1</identifier>` +
+		`<datestamp>2001-01-01</datestamp><metadataNamespace>http://www.openarchives.org/OAI/2.0/oai_dc/</metadataNamespace>` +
+		`</originDescription></provenance></about>` +
+		`<about><rights xmlns="http://www.openarchives.org/OAI/2.0/rights/">` +
+		`<rightsReference ref="http://creativecommons.org/licenses/by/4.0/"/></rights></about></record>`
+	var rec Record
+	if err := newRecordReader(bytes.NewBufferString(body)).next(&rec); err != nil {
+		t.Fatal(err)
+	}
+	origins := rec.Origins()
+	if len(origins) != 1 || origins[0].BaseURL != "http://a.example.org/oai" || !origins[0].Altered {
+		t.Errorf("Origins() got %+v", origins)
+	}
+	jr := NewJSONRecord(Request{}, rec)
+	if len(jr.About) != 2 || len(jr.Rights) != 1 || jr.Rights[0] != "http://creativecommons.org/licenses/by/4.0/" {
+		t.Errorf("NewJSONRecord() got about %v, rights %v", jr.About, jr.Rights)
+	}
+
+	for _, test := range []struct {
+		about string
+		n     int
+	}{
+		{"", 1},
+		{"creativecommons.org/licenses/by/4.0", 1},
+		{"creativecommons.org/licenses/by-nc/4.0", 0},
+	} {
+		var buf bytes.Buffer
+		c := NewCachingClientDir(&buf, t.TempDir())
+		c.About = test.about
+		write, err := c.recordWriter(Request{Verb: "ListRecords"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := write(rec); err != nil {
+			t.Fatal(err)
+		}
+		if n := bytes.Count(buf.Bytes(), []byte("<record>")); n != test.n {
+			t.Errorf("About %q: got %d records, want %d", test.about, n, test.n)
+		}
+		if test.n == 1 && bytes.Count(buf.Bytes(), []byte("<about>")) != 2 {
+			t.Errorf("About %q: got %s, want both about containers", test.about, buf.String())
+		}
+	}
+}
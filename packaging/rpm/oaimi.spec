@@ -24,6 +24,8 @@ mkdir -p $RPM_BUILD_ROOT/usr/local/sbin
 install -m 755 oaimi $RPM_BUILD_ROOT/usr/local/sbin
 install -m 755 oaimi-id $RPM_BUILD_ROOT/usr/local/sbin
 install -m 755 oaimi-sync $RPM_BUILD_ROOT/usr/local/sbin
+install -m 755 oaimi-serve $RPM_BUILD_ROOT/usr/local/sbin
+install -m 755 oaimi-check $RPM_BUILD_ROOT/usr/local/sbin
 
 %post
 
@@ -38,6 +40,8 @@ rm -rf %{_topdir}/BUILD/%{name}
 /usr/local/sbin/oaimi
 /usr/local/sbin/oaimi-id
 /usr/local/sbin/oaimi-sync
+/usr/local/sbin/oaimi-serve
+/usr/local/sbin/oaimi-check
 
 %changelog
 * Mon Sep 14 2015 Martin Czygan
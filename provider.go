@@ -0,0 +1,845 @@
+//  Copyright 2015 by Leipzig University Library, http://ub.uni-leipzig.de
+//                    The Finc Authors, http://finc.info
+//                    Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+//
+package oaimi
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/now"
+)
+
+// DefaultPageSize is the number of items in a single list response of a
+// Provider.
+var DefaultPageSize = 100
+
+// knownFormats maps common metadata prefixes to schema and namespace.
+var knownFormats = map[string][2]string{
+	"oai_dc":  {"http://www.openarchives.org/OAI/2.0/oai_dc.xsd", "http://www.openarchives.org/OAI/2.0/oai_dc/"},
+	"marc21":  {"http://www.loc.gov/standards/marcxml/schema/MARC21slim.xsd", "http://www.loc.gov/MARC21/slim"},
+	"marcxml": {"http://www.loc.gov/standards/marcxml/schema/MARC21slim.xsd", "http://www.loc.gov/MARC21/slim"},
+	"mods":    {"http://www.loc.gov/standards/mods/v3/mods-3-5.xsd", "http://www.loc.gov/mods/v3"},
+	"didl":    {"http://standards.iso.org/ittf/PubliclyAvailableStandards/MPEG-21_schema_files/did/didl.xsd", "urn:mpeg:mpeg21:2002:02-DIDL-NS"},
+}
+
+// providerEntry is a single item of a provider index.
+type providerEntry struct {
+	identifier string
+	datestamp  time.Time
+	sets       []string
+	deleted    bool
+	// shard is the index of the shard in the provider index, start and end
+	// locate the record in the uncompressed shard.
+	shard      int
+	start, end int64
+}
+
+// inSet reports whether the entry belongs to a set or one of its subsets.
+func (e providerEntry) inSet(spec string) bool {
+	for _, s := range e.sets {
+		if s == spec || strings.HasPrefix(s, spec+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// maxCursors is the number of shards per index, that are kept open between
+// requests.
+const maxCursors = 8
+
+// providerIndex holds the latest version of every record of a single
+// metadata format, sorted by datestamp.
+type providerIndex struct {
+	store   CacheStore
+	keys    []string
+	entries []providerEntry
+	byID    map[string]int
+
+	// mu guards the cursors, which are shards opened by earlier requests
+	mu      sync.Mutex
+	cursors map[int]*shardCursor
+	clock   int
+}
+
+// shardCursor is a shard, that is read sequentially.
+type shardCursor struct {
+	rc     io.ReadCloser
+	offset int64
+	// used is the clock of the index at the last read
+	used int
+}
+
+// records reads the records of the given entries from the shards. Shards
+// are read sequentially and kept open, so that the next page of a list
+// continues where the last one ended and only the records of the page are
+// decoded.
+func (ix *providerIndex) records(entries []providerEntry) ([]Record, error) {
+	order := make([]int, len(entries))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		x, y := entries[order[a]], entries[order[b]]
+		if x.shard != y.shard {
+			return x.shard < y.shard
+		}
+		return x.start < y.start
+	})
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	result := make([]Record, len(entries))
+	for _, i := range order {
+		b, err := ix.read(entries[i])
+		if err != nil {
+			return nil, err
+		}
+		if err := xml.Unmarshal(b, &result[i]); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// read returns the bytes of the record of an entry. A shard is opened again,
+// if the record comes before the current position. The caller must hold mu.
+func (ix *providerIndex) read(e providerEntry) ([]byte, error) {
+	ix.clock++
+	c, ok := ix.cursors[e.shard]
+	if ok && c.offset > e.start {
+		ix.drop(e.shard)
+		ok = false
+	}
+	if !ok {
+		rc, err := ix.store.Open(ix.keys[e.shard])
+		if err != nil {
+			return nil, err
+		}
+		if len(ix.cursors) >= maxCursors {
+			ix.evict()
+		}
+		c = &shardCursor{rc: rc}
+		ix.cursors[e.shard] = c
+	}
+	c.used = ix.clock
+	if _, err := io.CopyN(ioutil.Discard, c.rc, e.start-c.offset); err != nil {
+		ix.drop(e.shard)
+		return nil, err
+	}
+	b := make([]byte, e.end-e.start)
+	if _, err := io.ReadFull(c.rc, b); err != nil {
+		ix.drop(e.shard)
+		return nil, err
+	}
+	c.offset = e.end
+	return b, nil
+}
+
+// evict closes the least recently used shard. The caller must hold mu.
+func (ix *providerIndex) evict() {
+	lru := -1
+	for shard, c := range ix.cursors {
+		if lru < 0 || c.used < ix.cursors[lru].used {
+			lru = shard
+		}
+	}
+	if lru >= 0 {
+		ix.drop(lru)
+	}
+}
+
+// drop closes a shard. The caller must hold mu.
+func (ix *providerIndex) drop(shard int) {
+	if c, ok := ix.cursors[shard]; ok {
+		c.rc.Close()
+		delete(ix.cursors, shard)
+	}
+}
+
+// close closes all open shards.
+func (ix *providerIndex) close() {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for shard := range ix.cursors {
+		ix.drop(shard)
+	}
+}
+
+// Provider is an OAI-PMH 2.0 repository, that serves records harvested into
+// a cache. For every identifier, the latest version harvested is served.
+// The provider reads the cache once, records harvested later require a new
+// provider.
+type Provider struct {
+	// Identify is the answer to Identify requests. The base URL is taken from
+	// the request, if empty.
+	Identify Identify
+	// Formats lists the metadata formats available.
+	Formats ListMetadataFormats
+	// Sets lists the sets of the repository.
+	Sets ListSets
+	// PageSize is the number of items in a list response.
+	PageSize int
+	indexes  map[string]*providerIndex
+}
+
+// NewCacheProvider creates a provider for the records of an endpoint, that
+// have been harvested with ListRecords into a given cache dir. Information
+// about the repository, like its name, set names or schemas, can be adjusted
+// afterwards, e.g. with the result of AboutEndpoint.
+func NewCacheProvider(dir, endpoint string) (*Provider, error) {
+	return NewStoreProvider(FileStore{Dir: dir}, endpoint)
+}
+
+// NewStoreProvider is like NewCacheProvider, but serves the records from a
+// cache store.
+func NewStoreProvider(store CacheStore, endpoint string) (*Provider, error) {
+	root, err := shardPrefix(Request{Endpoint: endpoint, Verb: "ListRecords"})
+	if err != nil {
+		return nil, err
+	}
+	keys, err := store.List(root)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, &os.PathError{Op: "open", Path: root, Err: os.ErrNotExist}
+	}
+	// group the shards by metadata format, the first path component
+	byFormat := make(map[string][]string)
+	var prefixes []string
+	for _, key := range keys {
+		rel := strings.TrimPrefix(key, root+"/")
+		i := strings.Index(rel, "/")
+		if i < 0 {
+			continue
+		}
+		prefix := rel[:i]
+		if _, ok := byFormat[prefix]; !ok {
+			prefixes = append(prefixes, prefix)
+		}
+		byFormat[prefix] = append(byFormat[prefix], key)
+	}
+	p := &Provider{PageSize: DefaultPageSize, indexes: make(map[string]*providerIndex)}
+	p.Identify = Identify{
+		Name:         "oaimi mirror of " + endpoint,
+		Version:      "2.0",
+		AdminEmail:   "nobody@localhost",
+		DeletePolicy: "transient",
+		Granularity:  GranularityDay,
+	}
+	sets := make(map[string]bool)
+	var earliest time.Time
+	for _, prefix := range prefixes {
+		ix, err := buildIndex(store, root+"/"+prefix, byFormat[prefix])
+		if err != nil {
+			return nil, err
+		}
+		if len(ix.entries) == 0 {
+			continue
+		}
+		p.indexes[prefix] = ix
+		for _, e := range ix.entries {
+			for _, s := range e.sets {
+				sets[s] = true
+			}
+			if !e.datestamp.Equal(now.New(e.datestamp).BeginningOfDay()) {
+				p.Identify.Granularity = GranularitySecond
+			}
+		}
+		if first := ix.entries[0].datestamp; earliest.IsZero() || first.Before(earliest) {
+			earliest = first
+		}
+	}
+	p.Identify.EarliestDatestamp = p.formatDatestamp(earliest)
+	for prefix := range p.indexes {
+		schema := knownFormats[prefix]
+		p.Formats.Formats = append(p.Formats.Formats, struct {
+			Prefix    string `xml:"metadataPrefix" json:"prefix"`
+			Schema    string `xml:"schema" json:"schema"`
+			Namespace string `xml:"metadataNamespace" json:"namespace,omitempty"`
+		}{Prefix: prefix, Schema: schema[0], Namespace: schema[1]})
+	}
+	sort.Slice(p.Formats.Formats, func(i, j int) bool {
+		return p.Formats.Formats[i].Prefix < p.Formats.Formats[j].Prefix
+	})
+	for spec := range sets {
+		p.Sets.Sets = append(p.Sets.Sets, struct {
+			Spec        string `xml:"setSpec" json:"spec,omitempty"`
+			Name        string `xml:"setName" json:"name,omitempty"`
+			Description string `xml:"setDescription>dc>description,omitempty" json:"description,omitempty"`
+		}{Spec: spec, Name: spec})
+	}
+	sort.Slice(p.Sets.Sets, func(i, j int) bool { return p.Sets.Sets[i].Spec < p.Sets.Sets[j].Spec })
+	return p, nil
+}
+
+// Close releases the shards, that are kept open between requests.
+func (p *Provider) Close() error {
+	for _, ix := range p.indexes {
+		ix.close()
+	}
+	return nil
+}
+
+// shardKeys selects the shards of a format prefix from the given sorted
+// keys, including the shards of sets, together with the set spec of their
+// directory, if any. Shards without set come first.
+func shardKeys(prefix string, keys []string) (shards, specs []string) {
+	for _, key := range keys {
+		rel := strings.TrimPrefix(key, prefix+"/")
+		if !strings.HasSuffix(rel, ".xml.gz") {
+			continue
+		}
+		parts := strings.Split(rel, "/")
+		switch {
+		case len(parts) == 1:
+			shards = append(shards, key)
+			specs = append(specs, "")
+		case len(parts) == 2 && strings.HasPrefix(parts[0], "set-"):
+			spec, err := url.PathUnescape(strings.TrimPrefix(parts[0], "set-"))
+			if err != nil {
+				continue
+			}
+			shards = append(shards, key)
+			specs = append(specs, spec)
+		}
+	}
+	return shards, specs
+}
+
+// buildIndex reads all shards of a format prefix.
+func buildIndex(store CacheStore, prefix string, keys []string) (*providerIndex, error) {
+	shards, specs := shardKeys(prefix, keys)
+	ix := &providerIndex{store: store, keys: shards, byID: make(map[string]int),
+		cursors: make(map[int]*shardCursor)}
+	for i, spec := range specs {
+		if err := ix.add(i, spec); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(ix.entries, func(i, j int) bool {
+		a, b := ix.entries[i], ix.entries[j]
+		if a.datestamp.Equal(b.datestamp) {
+			return a.identifier < b.identifier
+		}
+		return a.datestamp.Before(b.datestamp)
+	})
+	for i, e := range ix.entries {
+		ix.byID[e.identifier] = i
+	}
+	return ix, nil
+}
+
+// add indexes the records of a shard, which belongs to the set with the
+// given spec, if not empty. Only the latest version of a record is kept.
+func (ix *providerIndex) add(shard int, spec string) error {
+	rc, err := ix.store.Open(ix.keys[shard])
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	rr := newRecordReader(rc)
+	var rec Record
+	for {
+		err := rr.next(&rec)
+		if err == io.EOF || err == errNoRecordsMatch {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		h := rec.Header
+		t, err := ParseDatestamp(h.Datestamp)
+		if err != nil {
+			if Verbose {
+				log.Printf("skipping %s: %s", h.Identifier, err)
+			}
+			continue
+		}
+		sets := append([]string{}, h.SetSpec...)
+		if spec != "" {
+			sets = appendUnique(sets, spec)
+		}
+		if i, ok := ix.byID[h.Identifier]; ok {
+			e := &ix.entries[i]
+			for _, s := range sets {
+				e.sets = appendUnique(e.sets, s)
+			}
+			if t.Before(e.datestamp) {
+				continue
+			}
+			e.datestamp, e.deleted = t, h.Deleted()
+			e.shard, e.start, e.end = shard, rr.start, rr.end
+			continue
+		}
+		ix.byID[h.Identifier] = len(ix.entries)
+		ix.entries = append(ix.entries, providerEntry{
+			identifier: h.Identifier,
+			datestamp:  t,
+			sets:       sets,
+			deleted:    h.Deleted(),
+			shard:      shard,
+			start:      rr.start,
+			end:        rr.end,
+		})
+	}
+}
+
+// appendUnique appends s to ss, if it is not already contained.
+func appendUnique(ss []string, s string) []string {
+	for _, v := range ss {
+		if v == s {
+			return ss
+		}
+	}
+	return append(ss, s)
+}
+
+// formatDatestamp formats a time in the granularity of the repository.
+func (p *Provider) formatDatestamp(t time.Time) string {
+	if p.Identify.Granularity == GranularitySecond {
+		return t.UTC().Format("2006-01-02T15:04:05Z")
+	}
+	return t.Format("2006-01-02")
+}
+
+// header returns the header of an index entry.
+func (p *Provider) header(e providerEntry) header {
+	h := header{Identifier: e.identifier, Datestamp: p.formatDatestamp(e.datestamp), SetSpec: e.sets}
+	if e.deleted {
+		h.Status = "deleted"
+	}
+	return h
+}
+
+// providerRequest is the request element of a response.
+type providerRequest struct {
+	Verb            string `xml:"verb,attr,omitempty"`
+	Identifier      string `xml:"identifier,attr,omitempty"`
+	Prefix          string `xml:"metadataPrefix,attr,omitempty"`
+	From            string `xml:"from,attr,omitempty"`
+	Until           string `xml:"until,attr,omitempty"`
+	Set             string `xml:"set,attr,omitempty"`
+	ResumptionToken string `xml:"resumptionToken,attr,omitempty"`
+	BaseURL         string `xml:",chardata"`
+}
+
+// providerError is the error element of a response.
+type providerError struct {
+	Code    string `xml:"code,attr"`
+	Message string `xml:",chardata"`
+}
+
+// providerResponse is the envelope of every response. Unlike Response, only
+// the parts, that are set, are serialized.
+type providerResponse struct {
+	XMLName        xml.Name        `xml:"OAI-PMH"`
+	Namespace      string          `xml:"xmlns,attr"`
+	Xsi            string          `xml:"xmlns:xsi,attr"`
+	SchemaLocation string          `xml:"xsi:schemaLocation,attr"`
+	Date           string          `xml:"responseDate"`
+	Request        providerRequest `xml:"request"`
+	Errors         []providerError `xml:"error,omitempty"`
+	Identify       *Identify       `xml:"Identify,omitempty"`
+
+	ListMetadataFormats *ListMetadataFormats `xml:"ListMetadataFormats,omitempty"`
+	ListSets            *struct {
+		Sets interface{} `xml:"set"`
+	} `xml:"ListSets,omitempty"`
+	ListIdentifiers *struct {
+		Headers []header         `xml:"header"`
+		Token   *resumptionToken `xml:"resumptionToken,omitempty"`
+	} `xml:"ListIdentifiers,omitempty"`
+	ListRecords *struct {
+		Records []Record         `xml:"record"`
+		Token   *resumptionToken `xml:"resumptionToken,omitempty"`
+	} `xml:"ListRecords,omitempty"`
+	GetRecord *struct {
+		Record Record `xml:"record"`
+	} `xml:"GetRecord,omitempty"`
+}
+
+// allowedArguments lists required (true) and optional (false) arguments per
+// verb, besides the verb itself. The resumptionToken is exclusive.
+var allowedArguments = map[string]map[string]bool{
+	"Identify":            {},
+	"ListMetadataFormats": {"identifier": false},
+	"ListSets":            {"resumptionToken": false},
+	"GetRecord":           {"identifier": true, "metadataPrefix": true},
+	"ListIdentifiers": {"metadataPrefix": true, "from": false, "until": false,
+		"set": false, "resumptionToken": false},
+	"ListRecords": {"metadataPrefix": true, "from": false, "until": false,
+		"set": false, "resumptionToken": false},
+}
+
+// checkArguments validates the arguments of a request (3.1.1).
+func checkArguments(verb string, args url.Values) *providerError {
+	allowed := allowedArguments[verb]
+	for k, vs := range args {
+		if k == "verb" {
+			continue
+		}
+		if _, ok := allowed[k]; !ok {
+			return &providerError{"badArgument", "illegal argument: " + k}
+		}
+		if len(vs) > 1 {
+			return &providerError{"badArgument", "repeated argument: " + k}
+		}
+	}
+	if _, ok := args["resumptionToken"]; ok {
+		if len(args) > 2 {
+			return &providerError{"badArgument", "resumptionToken is an exclusive argument"}
+		}
+		return nil
+	}
+	for k, required := range allowed {
+		if _, ok := args[k]; required && !ok {
+			return &providerError{"badArgument", "missing argument: " + k}
+		}
+	}
+	return nil
+}
+
+// ServeHTTP answers OAI-PMH requests, either GET or POST.
+func (p *Provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	baseURL := p.Identify.URL
+	if baseURL == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		baseURL = scheme + "://" + r.Host + r.URL.Path
+	}
+	resp := providerResponse{
+		Namespace:      "http://www.openarchives.org/OAI/2.0/",
+		Xsi:            "http://www.w3.org/2001/XMLSchema-instance",
+		SchemaLocation: "http://www.openarchives.org/OAI/2.0/ http://www.openarchives.org/OAI/2.0/OAI-PMH.xsd",
+		Date:           time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+		Request:        providerRequest{BaseURL: baseURL},
+	}
+	args := r.Form
+	verb := args.Get("verb")
+	var perr *providerError
+	switch _, ok := allowedArguments[verb]; {
+	case len(args["verb"]) != 1 || !ok:
+		perr = &providerError{"badVerb", "illegal or missing verb"}
+	default:
+		perr = checkArguments(verb, args)
+	}
+	if perr == nil {
+		// Attributes are only echoed for requests without badVerb or
+		// badArgument errors (3.2).
+		resp.Request = providerRequest{
+			Verb:            verb,
+			Identifier:      args.Get("identifier"),
+			Prefix:          args.Get("metadataPrefix"),
+			From:            args.Get("from"),
+			Until:           args.Get("until"),
+			Set:             args.Get("set"),
+			ResumptionToken: args.Get("resumptionToken"),
+			BaseURL:         baseURL,
+		}
+		var err error
+		if perr, err = p.answer(verb, args, baseURL, &resp); err != nil {
+			// an unreadable cache is not a protocol condition, so the
+			// harvester must not conclude, that there are no records
+			log.Printf("%s: %s", r.URL, err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if perr != nil {
+		resp.Errors = []providerError{*perr}
+	}
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	if err := enc.Encode(resp); err != nil && Verbose {
+		log.Println(err)
+	}
+}
+
+// answer fills in the response for a verb with valid arguments. Errors other
+// than protocol errors, e.g. failing to read the cache, are returned as error.
+func (p *Provider) answer(verb string, args url.Values, baseURL string, resp *providerResponse) (*providerError, error) {
+	switch verb {
+	case "Identify":
+		id := p.Identify
+		id.URL = baseURL
+		resp.Identify = &id
+	case "ListMetadataFormats":
+		formats := p.Formats
+		if identifier := args.Get("identifier"); identifier != "" {
+			formats.Formats = nil
+			for _, f := range p.Formats.Formats {
+				if ix, ok := p.indexes[f.Prefix]; ok {
+					if _, found := ix.byID[identifier]; found {
+						formats.Formats = append(formats.Formats, f)
+					}
+				}
+			}
+			if len(formats.Formats) == 0 {
+				return &providerError{"idDoesNotExist", "no such identifier: " + identifier}, nil
+			}
+		}
+		if len(formats.Formats) == 0 {
+			return &providerError{"noMetadataFormats", "no metadata formats available"}, nil
+		}
+		resp.ListMetadataFormats = &formats
+	case "ListSets":
+		if args.Get("resumptionToken") != "" {
+			return &providerError{"badResumptionToken", "invalid resumption token"}, nil
+		}
+		if len(p.Sets.Sets) == 0 {
+			return &providerError{"noSetHierarchy", "repository does not support sets"}, nil
+		}
+		resp.ListSets = &struct {
+			Sets interface{} `xml:"set"`
+		}{Sets: p.Sets.Sets}
+	case "GetRecord":
+		identifier, prefix := args.Get("identifier"), args.Get("metadataPrefix")
+		ix, ok := p.indexes[prefix]
+		if !ok {
+			if p.exists(identifier) {
+				return &providerError{"cannotDisseminateFormat", "format not available: " + prefix}, nil
+			}
+			return &providerError{"idDoesNotExist", "no such identifier: " + identifier}, nil
+		}
+		i, ok := ix.byID[identifier]
+		if !ok {
+			if p.exists(identifier) {
+				return &providerError{"cannotDisseminateFormat", "format not available for item: " + prefix}, nil
+			}
+			return &providerError{"idDoesNotExist", "no such identifier: " + identifier}, nil
+		}
+		records, err := p.records(ix, ix.entries[i:i+1])
+		if err != nil {
+			return nil, err
+		}
+		resp.GetRecord = &struct {
+			Record Record `xml:"record"`
+		}{Record: records[0]}
+	case "ListIdentifiers", "ListRecords":
+		return p.list(verb, args, resp)
+	}
+	return nil, nil
+}
+
+// exists reports whether an identifier is available in any format.
+func (p *Provider) exists(identifier string) bool {
+	for _, ix := range p.indexes {
+		if _, ok := ix.byID[identifier]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// records reads the records of the given entries with headers taken from the
+// index, so datestamps and sets are consistent across responses.
+func (p *Provider) records(ix *providerIndex, entries []providerEntry) ([]Record, error) {
+	records, err := ix.records(entries)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range entries {
+		records[i].Header = p.header(e)
+	}
+	return records, nil
+}
+
+// listState is the state of a list request sequence, which is encoded into
+// the resumption token, so the provider itself is stateless.
+type listState struct {
+	verb, prefix, set, from, until string
+	// next is the position in the index to continue from, cursor the number of
+	// items returned so far and size the complete list size.
+	next, cursor, size int
+}
+
+// encode returns the resumption token for the state.
+func (s listState) encode() string {
+	v := url.Values{}
+	v.Set("v", s.verb)
+	v.Set("p", s.prefix)
+	v.Set("s", s.set)
+	v.Set("f", s.from)
+	v.Set("u", s.until)
+	v.Set("n", strconv.Itoa(s.next))
+	v.Set("c", strconv.Itoa(s.cursor))
+	v.Set("z", strconv.Itoa(s.size))
+	return base64.RawURLEncoding.EncodeToString([]byte(v.Encode()))
+}
+
+// decodeListState parses a resumption token.
+func decodeListState(token string) (s listState, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return s, err
+	}
+	v, err := url.ParseQuery(string(b))
+	if err != nil {
+		return s, err
+	}
+	s = listState{verb: v.Get("v"), prefix: v.Get("p"), set: v.Get("s"), from: v.Get("f"), until: v.Get("u")}
+	if s.next, err = strconv.Atoi(v.Get("n")); err != nil {
+		return s, err
+	}
+	if s.cursor, err = strconv.Atoi(v.Get("c")); err != nil {
+		return s, err
+	}
+	s.size, err = strconv.Atoi(v.Get("z"))
+	return s, err
+}
+
+// parseBound parses a from or until argument. Arguments finer than the
+// granularity of the repository are not allowed. An until date includes the
+// whole day.
+func (p *Provider) parseBound(s string, until bool) (time.Time, bool, error) {
+	if s == "" {
+		return time.Time{}, false, nil
+	}
+	if len(s) > len("2006-01-02") && p.Identify.Granularity != GranularitySecond {
+		return time.Time{}, false, os.ErrInvalid
+	}
+	parse := ParseDatestamp
+	if until {
+		parse = ParseUntil
+	}
+	t, err := parse(s)
+	return t, len(s) > len("2006-01-02"), err
+}
+
+// list answers ListIdentifiers and ListRecords requests.
+func (p *Provider) list(verb string, args url.Values, resp *providerResponse) (*providerError, error) {
+	var state listState
+	if token := args.Get("resumptionToken"); token != "" {
+		var err error
+		if state, err = decodeListState(token); err != nil || state.verb != verb {
+			return &providerError{"badResumptionToken", "invalid resumption token"}, nil
+		}
+	} else {
+		state = listState{verb: verb, prefix: args.Get("metadataPrefix"), set: args.Get("set"),
+			from: args.Get("from"), until: args.Get("until"), size: -1}
+	}
+	from, ffine, err := p.parseBound(state.from, false)
+	if err != nil {
+		return &providerError{"badArgument", "invalid from: " + state.from}, nil
+	}
+	until, ufine, err := p.parseBound(state.until, true)
+	if err != nil {
+		return &providerError{"badArgument", "invalid until: " + state.until}, nil
+	}
+	if state.from != "" && state.until != "" && ffine != ufine {
+		return &providerError{"badArgument", "from and until must have the same granularity"}, nil
+	}
+	if state.from != "" && state.until != "" && from.After(until) {
+		return &providerError{"badArgument", "from must not be after until"}, nil
+	}
+	ix, ok := p.indexes[state.prefix]
+	if !ok {
+		return &providerError{"cannotDisseminateFormat", "format not available: " + state.prefix}, nil
+	}
+	if state.set != "" && len(p.Sets.Sets) == 0 {
+		return &providerError{"noSetHierarchy", "repository does not support sets"}, nil
+	}
+	match := func(e providerEntry) bool {
+		if state.from != "" && e.datestamp.Before(from) {
+			return false
+		}
+		if state.until != "" && e.datestamp.After(until) {
+			return false
+		}
+		return state.set == "" || e.inSet(state.set)
+	}
+	// entries are sorted by datestamp, so skip everything before from
+	start := sort.Search(len(ix.entries), func(i int) bool { return !ix.entries[i].datestamp.Before(from) })
+	if state.size < 0 {
+		state.size, state.next = 0, start
+		for _, e := range ix.entries[start:] {
+			if match(e) {
+				state.size++
+			}
+		}
+		if state.size == 0 {
+			return &providerError{"noRecordsMatch", "no records match"}, nil
+		}
+	}
+	if state.next < 0 || state.next > len(ix.entries) || state.cursor > state.size {
+		return &providerError{"badResumptionToken", "invalid resumption token"}, nil
+	}
+	var page []providerEntry
+	i := state.next
+	for ; i < len(ix.entries) && len(page) < p.PageSize; i++ {
+		if match(ix.entries[i]) {
+			page = append(page, ix.entries[i])
+		}
+	}
+	var token *resumptionToken
+	if state.cursor > 0 || state.cursor+len(page) < state.size {
+		token = &resumptionToken{Cursor: strconv.Itoa(state.cursor), CompleteListSize: strconv.Itoa(state.size)}
+		if state.cursor+len(page) < state.size {
+			next := state
+			next.next, next.cursor = i, state.cursor+len(page)
+			token.Value = next.encode()
+		}
+	}
+	switch verb {
+	case "ListIdentifiers":
+		resp.ListIdentifiers = &struct {
+			Headers []header         `xml:"header"`
+			Token   *resumptionToken `xml:"resumptionToken,omitempty"`
+		}{Token: token}
+		for _, e := range page {
+			resp.ListIdentifiers.Headers = append(resp.ListIdentifiers.Headers, p.header(e))
+		}
+	case "ListRecords":
+		records, err := p.records(ix, page)
+		if err != nil {
+			return nil, err
+		}
+		resp.ListRecords = &struct {
+			Records []Record         `xml:"record"`
+			Token   *resumptionToken `xml:"resumptionToken,omitempty"`
+		}{Records: records, Token: token}
+	}
+	return nil, nil
+}
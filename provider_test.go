@@ -0,0 +1,208 @@
+package oaimi
+
+import (
+	"compress/gzip"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miku/oaimi/oaitest"
+)
+
+// writeShard writes a gzipped shard below dir.
+func writeShard(t *testing.T, dir, name, body string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := gzip.NewWriter(f)
+	if _, err := w.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProvider(t *testing.T) {
+	cache := t.TempDir()
+	endpoint := "http://example.com/oai"
+	c := CachingClient{CacheDir: cache}
+	dir, err := c.shardDir(Request{Endpoint: endpoint, Verb: "ListRecords", Prefix: "oai_dc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeShard(t, dir, "2000-01-01-2000-01-07.xml.gz", `<OAI-PMH><ListRecords>
+		<record><header><identifier>a</identifier><datestamp>2000-01-01</datestamp></header><metadata><dc>a1</dc></metadata></record>
+		<record><header><identifier>b</identifier><datestamp>2000-01-02</datestamp></header><metadata><dc>b1</dc></metadata></record>
+		<record><header><identifier>c</identifier><datestamp>2000-01-03</datestamp></header><metadata><dc>c1</dc></metadata></record>
+		</ListRecords></OAI-PMH>`)
+	writeShard(t, filepath.Join(dir, setDir("x:y")), "2000-01-08-2000-01-14.xml.gz", `<OAI-PMH><ListRecords>
+		<record><header><identifier>a</identifier><datestamp>2000-01-08</datestamp></header><metadata><dc>a2</dc></metadata></record>
+		<record><header status="deleted"><identifier>d</identifier><datestamp>2000-01-09</datestamp></header></record>
+		</ListRecords></OAI-PMH>`)
+
+	p, err := NewCacheProvider(cache, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.PageSize = 2
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+	if p.Identify.EarliestDatestamp != "2000-01-02" || p.Identify.Granularity != GranularityDay {
+		t.Errorf("Identify got %+v", p.Identify)
+	}
+
+	client := NewClientDoer(http.DefaultClient)
+	list := func(req Request) (ids, data []string, err error) {
+		it := NewRecordIteratorClient(client, req)
+		defer it.Close()
+		for it.Next() {
+			ids = append(ids, it.Record().Header.Identifier)
+			data = append(data, it.Record().Metadata.Verbatim)
+		}
+		return ids, data, it.Err()
+	}
+
+	ids, data, err := list(Request{Endpoint: ts.URL, Verb: "ListRecords", Prefix: "oai_dc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b", "c", "a", "d"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("ListRecords got %v, want %v", ids, want)
+	}
+	if want := []string{"<dc>b1</dc>", "<dc>c1</dc>", "<dc>a2</dc>", ""}; !reflect.DeepEqual(data, want) {
+		t.Errorf("ListRecords metadata got %v, want %v", data, want)
+	}
+
+	ids, _, err = list(Request{Endpoint: ts.URL, Verb: "ListRecords", Prefix: "oai_dc", Set: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "d"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("ListRecords with set got %v, want %v", ids, want)
+	}
+
+	var tests = []struct {
+		query string
+		err   error
+	}{
+		{"verb=Identify", nil},
+		{"verb=ListSets", nil},
+		{"verb=ListMetadataFormats&identifier=a", nil},
+		{"verb=GetRecord&identifier=a&metadataPrefix=oai_dc", nil},
+		{"verb=Nope", OAIError{Code: "badVerb", Message: "illegal or missing verb"}},
+		{"verb=Identify&verb=Identify", OAIError{Code: "badVerb", Message: "illegal or missing verb"}},
+		{"verb=GetRecord&identifier=a", OAIError{Code: "badArgument", Message: "missing argument: metadataPrefix"}},
+		{"verb=GetRecord&identifier=z&metadataPrefix=oai_dc", OAIError{Code: "idDoesNotExist", Message: "no such identifier: z"}},
+		{"verb=GetRecord&identifier=a&metadataPrefix=marc", OAIError{Code: "cannotDisseminateFormat", Message: "format not available: marc"}},
+		{"verb=ListRecords&metadataPrefix=oai_dc&from=2001-01-01", OAIError{Code: "noRecordsMatch", Message: "no records match"}},
+		{"verb=ListRecords&metadataPrefix=oai_dc&from=2000-01-01T00:00:00Z", OAIError{Code: "badArgument", Message: "invalid from: 2000-01-01T00:00:00Z"}},
+		{"verb=ListRecords&resumptionToken=xyz", OAIError{Code: "badResumptionToken", Message: "invalid resumption token"}},
+		{"verb=ListRecords&metadataPrefix=oai_dc&resumptionToken=xyz", OAIError{Code: "badArgument", Message: "resumptionToken is an exclusive argument"}},
+	}
+	for _, test := range tests {
+		// the client only builds valid requests, so query the server directly
+		r, err := http.Get(ts.URL + "?" + test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp Response
+		if err := xml.NewDecoder(r.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		var got error
+		if resp.Error.Code != "" {
+			got = OAIError{Code: resp.Error.Code, Message: resp.Error.Message}
+		}
+		if got != test.err {
+			t.Errorf("%s: got %v, want %v", test.query, got, test.err)
+		}
+		if test.query == "verb=Identify" && resp.Identify.URL != ts.URL+"/" {
+			t.Errorf("baseURL got %v, want %v", resp.Identify.URL, ts.URL+"/")
+		}
+	}
+}
+
+// countingStore counts the shards opened.
+type countingStore struct {
+	CacheStore
+	mu    sync.Mutex
+	opens int
+}
+
+func (s *countingStore) Open(key string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	s.opens++
+	s.mu.Unlock()
+	return s.CacheStore.Open(key)
+}
+
+func TestProviderReadsShardsOnce(t *testing.T) {
+	ts := oaitest.NewServer(oaitest.Config{Records: testRecords(30)})
+	defer ts.Close()
+	dir := t.TempDir()
+	req := Request{
+		Endpoint:    ts.URL,
+		Verb:        "ListRecords",
+		Prefix:      "oai_dc",
+		From:        time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		Until:       time.Date(2000, 1, 31, 0, 0, 0, 0, time.UTC),
+		Granularity: GranularityDay,
+	}
+	if err := NewCachingClientDir(ioutil.Discard, dir).Do(req); err != nil {
+		t.Fatal(err)
+	}
+	store := &countingStore{CacheStore: FileStore{Dir: dir}}
+	p, err := NewStoreProvider(store, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.PageSize = 2
+	shards := store.opens
+	ps := httptest.NewServer(p)
+	defer ps.Close()
+
+	var n int
+	it := NewRecordIteratorClient(NewClientDoer(http.DefaultClient), Request{Endpoint: ps.URL, Verb: "ListRecords", Prefix: "oai_dc"})
+	for it.Next() {
+		n++
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 30 {
+		t.Errorf("got %d records, want 30", n)
+	}
+	if store.opens != 2*shards {
+		t.Errorf("got %d shards opened for the list, want %d", store.opens-shards, shards)
+	}
+
+	// a cache, that cannot be read, is not an empty list
+	p.Close()
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	r, err := http.Get(ps.URL + "?verb=ListRecords&metadataPrefix=oai_dc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusInternalServerError {
+		t.Errorf("got status %d, want %d", r.StatusCode, http.StatusInternalServerError)
+	}
+}
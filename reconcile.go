@@ -0,0 +1,155 @@
+//  Copyright 2015 by Leipzig University Library, http://ub.uni-leipzig.de
+//                    The Finc Authors, http://finc.info
+//                    Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+//
+package oaimi
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// Entry is a record, that has been found in only one of the lists compared
+// by Reconcile.
+type Entry struct {
+	Identifier string `json:"identifier"`
+	Datestamp  string `json:"datestamp"`
+	Deleted    bool   `json:"deleted,omitempty"`
+}
+
+// Mismatch is a record, that has different datestamps in ListIdentifiers and
+// ListRecords responses.
+type Mismatch struct {
+	Identifier string `json:"identifier"`
+	// Identifiers is the datestamp in the ListIdentifiers response.
+	Identifiers string `json:"identifiers"`
+	// Records is the datestamp in the ListRecords response.
+	Records string `json:"records"`
+}
+
+// Reconciliation compares the ListIdentifiers and ListRecords responses of a
+// repository for the same window. Only the latest version of each record is
+// compared.
+type Reconciliation struct {
+	Endpoint string    `json:"endpoint"`
+	Prefix   string    `json:"prefix"`
+	Set      string    `json:"set,omitempty"`
+	From     time.Time `json:"from"`
+	Until    time.Time `json:"until"`
+	// Identifiers and Records are the number of distinct identifiers found
+	// in the respective lists.
+	Identifiers int `json:"identifiers"`
+	Records     int `json:"records"`
+	// Missing records are listed by ListIdentifiers, but not by ListRecords.
+	Missing []Entry `json:"missing,omitempty"`
+	// Extra records are listed by ListRecords, but not by ListIdentifiers.
+	Extra      []Entry    `json:"extra,omitempty"`
+	Mismatched []Mismatch `json:"mismatched,omitempty"`
+}
+
+// OK reports whether both lists agree.
+func (r Reconciliation) OK() bool {
+	return len(r.Missing) == 0 && len(r.Extra) == 0 && len(r.Mismatched) == 0
+}
+
+// sameDatestamp reports whether two datestamps denote the same time, so
+// 2000-01-01 and 2000-01-01T00:00:00Z are considered equal. Datestamps, that
+// cannot be parsed, are compared verbatim.
+func sameDatestamp(a, b string) bool {
+	s, err := ParseDatestamp(a)
+	if err != nil {
+		return a == b
+	}
+	t, err := ParseDatestamp(b)
+	if err != nil {
+		return a == b
+	}
+	return s.Equal(t)
+}
+
+// latestHeaders returns the latest header of every record in the shards of
+// a list request, keyed by identifier.
+func (c CachingClient) latestHeaders(ctx context.Context, req Request) (map[string]header, error) {
+	headers := make(map[string]header)
+	err := c.eachShard(ctx, req, func(key string, keep func(header) bool) error {
+		return eachRecord(c.store(), []string{key}, func(_ position, rec Record) error {
+			h := rec.Header
+			if keep != nil && !keep(h) {
+				return nil
+			}
+			if v, ok := headers[h.Identifier]; ok && v.Datestamp > h.Datestamp {
+				return nil
+			}
+			headers[h.Identifier] = h
+			return nil
+		})
+	})
+	return headers, err
+}
+
+// Reconcile harvests the ListIdentifiers and the ListRecords responses for
+// the window of a given request and compares them. Both are cached like any
+// other list request. The verb of the request is ignored.
+func (c CachingClient) Reconcile(req Request) (Reconciliation, error) {
+	return c.ReconcileContext(context.Background(), req)
+}
+
+// ReconcileContext is like Reconcile, but the request can be cancelled
+// through the context.
+func (c CachingClient) ReconcileContext(ctx context.Context, req Request) (Reconciliation, error) {
+	req.Verb = "ListIdentifiers"
+	req.UseDefaultsContext(ctx)
+	r := Reconciliation{
+		Endpoint: req.Endpoint,
+		Prefix:   req.Prefix,
+		Set:      req.Set,
+		From:     req.From,
+		Until:    req.Until,
+	}
+	identifiers, err := c.latestHeaders(ctx, req)
+	if err != nil {
+		return r, err
+	}
+	req.Verb = "ListRecords"
+	records, err := c.latestHeaders(ctx, req)
+	if err != nil {
+		return r, err
+	}
+	r.Identifiers, r.Records = len(identifiers), len(records)
+	for id, h := range identifiers {
+		v, ok := records[id]
+		switch {
+		case !ok:
+			r.Missing = append(r.Missing, Entry{Identifier: id, Datestamp: h.Datestamp, Deleted: h.Deleted()})
+		case !sameDatestamp(v.Datestamp, h.Datestamp):
+			r.Mismatched = append(r.Mismatched, Mismatch{Identifier: id, Identifiers: h.Datestamp, Records: v.Datestamp})
+		}
+	}
+	for id, h := range records {
+		if _, ok := identifiers[id]; !ok {
+			r.Extra = append(r.Extra, Entry{Identifier: id, Datestamp: h.Datestamp, Deleted: h.Deleted()})
+		}
+	}
+	sort.Slice(r.Missing, func(i, j int) bool { return r.Missing[i].Identifier < r.Missing[j].Identifier })
+	sort.Slice(r.Extra, func(i, j int) bool { return r.Extra[i].Identifier < r.Extra[j].Identifier })
+	sort.Slice(r.Mismatched, func(i, j int) bool { return r.Mismatched[i].Identifier < r.Mismatched[j].Identifier })
+	return r, nil
+}
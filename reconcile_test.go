@@ -0,0 +1,57 @@
+package oaimi
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miku/oaimi/oaitest"
+)
+
+func TestReconcile(t *testing.T) {
+	listed := testRecords(6)
+	harvested := testRecords(6)
+	harvested = append(harvested[:2], harvested[3:]...)
+	harvested[3].Datestamp = harvested[3].Datestamp.Add(time.Hour)
+	harvested = append(harvested, oaitest.Record{Identifier: "x", Datestamp: time.Date(2000, 1, 3, 0, 0, 0, 0, time.UTC)})
+
+	identifiers := oaitest.NewHandler(oaitest.Config{Records: listed})
+	records := oaitest.NewHandler(oaitest.Config{Records: harvested, Granularity: "YYYY-MM-DDThh:mm:ssZ"})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("verb") == "ListRecords" {
+			records.ServeHTTP(w, r)
+			return
+		}
+		identifiers.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	c := NewCachingClientDir(ioutil.Discard, t.TempDir())
+	r, err := c.Reconcile(Request{
+		Endpoint:    ts.URL,
+		Prefix:      "oai_dc",
+		From:        time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		Until:       time.Date(2000, 1, 31, 0, 0, 0, 0, time.UTC),
+		Granularity: GranularityDay,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.OK() {
+		t.Fatal("OK() got true, want false")
+	}
+	if r.Identifiers != 6 || r.Records != 6 {
+		t.Errorf("got %d identifiers, %d records, want 6, 6", r.Identifiers, r.Records)
+	}
+	if len(r.Missing) != 1 || r.Missing[0].Identifier != "r2" {
+		t.Errorf("Missing got %+v, want r2", r.Missing)
+	}
+	if len(r.Extra) != 1 || r.Extra[0].Identifier != "x" {
+		t.Errorf("Extra got %+v, want x", r.Extra)
+	}
+	if len(r.Mismatched) != 1 || r.Mismatched[0].Identifier != "r4" {
+		t.Errorf("Mismatched got %+v, want r4", r.Mismatched)
+	}
+}
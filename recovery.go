@@ -0,0 +1,220 @@
+//  Copyright 2015 by Leipzig University Library, http://ub.uni-leipzig.de
+//                    The Finc Authors, http://finc.info
+//                    Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+//
+package oaimi
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// listRecovery follows a ListRecords or ListIdentifiers request sequence, so
+// that it can be restarted, if the repository does not accept a resumption
+// token anymore. The restarted list begins at the datestamp of the last item
+// received. Items, that have been received before, are dropped.
+type listRecovery struct {
+	// req is the first request of the sequence.
+	req Request
+	// last is the datestamp of the last item received.
+	last time.Time
+	// unordered is set, if the items did not arrive in datestamp order. The
+	// list is restarted from the beginning then.
+	unordered bool
+	// progress is set, if new items arrived since the last restart.
+	progress bool
+	seen     map[string]bool
+}
+
+// newListRecovery starts to follow a request sequence. Returns nil for verbs,
+// whose lists cannot be restarted.
+func newListRecovery(req Request) *listRecovery {
+	switch req.Verb {
+	case "ListRecords", "ListIdentifiers":
+		req.ResumptionToken = ""
+		return &listRecovery{req: req, seen: make(map[string]bool)}
+	}
+	return nil
+}
+
+// filter records the items of a response and removes those, that have been
+// received before.
+func (r *listRecovery) filter(resp *Response) {
+	if r == nil {
+		return
+	}
+	switch r.req.Verb {
+	case "ListRecords":
+		var records []Record
+		for _, rec := range resp.ListRecords.Records {
+			if r.observe(rec.Header) {
+				records = append(records, rec)
+			}
+		}
+		resp.ListRecords.Records = records
+	case "ListIdentifiers":
+		var headers []header
+		for _, h := range resp.ListIdentifiers.Header {
+			if r.observe(h) {
+				headers = append(headers, h)
+			}
+		}
+		resp.ListIdentifiers.Header = headers
+	}
+}
+
+// decodePage decodes a response body in UTF-8, as returned by fetchPage, and
+// cuts out the items, that have been received before, in a single pass.
+// Everything else is left untouched. Only the request, error and resumption
+// token are decoded into the response, not the items. An OAI error is
+// returned as OAIError. Without recovery, the whole response is decoded.
+func (r *listRecovery) decodePage(page []byte) (Response, []byte, error) {
+	if r == nil {
+		resp, err := decodeResponse(page)
+		return resp, page, err
+	}
+	var resp Response
+	dec := xml.NewDecoder(bytes.NewReader(page))
+	var buf bytes.Buffer
+	var last int64
+	for {
+		start := dec.InputOffset()
+		t, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return resp, nil, err
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		var h header
+		switch se.Name.Local {
+		case "request":
+			if err := dec.DecodeElement(&resp.Request, &se); err != nil {
+				return resp, nil, err
+			}
+			continue
+		case "error":
+			if err := dec.DecodeElement(&resp.Error, &se); err != nil {
+				return resp, nil, err
+			}
+			continue
+		case "resumptionToken":
+			var token resumptionToken
+			if err := dec.DecodeElement(&token, &se); err != nil {
+				return resp, nil, err
+			}
+			resp.ListRecords.Token, resp.ListIdentifiers.Token = token, token
+			continue
+		case "record":
+			var rec Record
+			if err := dec.DecodeElement(&rec, &se); err != nil {
+				return resp, nil, err
+			}
+			h = rec.Header
+		case "header":
+			if err := dec.DecodeElement(&h, &se); err != nil {
+				return resp, nil, err
+			}
+		default:
+			continue
+		}
+		if !r.observe(h) {
+			buf.Write(page[last:start])
+			last = dec.InputOffset()
+		}
+	}
+	if resp.Error.Code != "" {
+		return resp, page, OAIError{Code: resp.Error.Code, Message: resp.Error.Message}
+	}
+	if last == 0 {
+		return resp, page, nil
+	}
+	buf.Write(page[last:])
+	return resp, buf.Bytes(), nil
+}
+
+// observe reports whether an item is new and tracks the last datestamp.
+func (r *listRecovery) observe(h header) bool {
+	key := h.Identifier + "\x00" + strings.TrimSpace(h.Datestamp)
+	if r.seen[key] {
+		return false
+	}
+	r.seen[key] = true
+	r.progress = true
+	t, err := ParseDatestamp(h.Datestamp)
+	if err != nil {
+		r.unordered = true
+		return true
+	}
+	if t.Before(r.last) {
+		r.unordered = true
+	}
+	r.last = t
+	return true
+}
+
+// restart returns the request, that continues the list without a resumption
+// token. Returns false, if nothing has been received since the last restart,
+// so a repository, that keeps rejecting tokens, cannot cause a loop.
+func (r *listRecovery) restart() (Request, bool) {
+	if r == nil || !r.progress {
+		return Request{}, false
+	}
+	r.progress = false
+	req := r.req
+	if !r.unordered && r.last.After(req.From) {
+		req.From = r.last
+	}
+	if Verbose {
+		log.Printf("restarting list from %s", req.From.Format(time.RFC3339))
+	}
+	return req, true
+}
+
+// tokenExpiry returns the expiration date of the resumption token of a
+// response, or the zero time, if there is none or it cannot be parsed.
+func tokenExpiry(resp Response) time.Time {
+	var token resumptionToken
+	switch resp.Request.Verb {
+	case "ListIdentifiers":
+		token = resp.ListIdentifiers.Token
+	case "ListRecords":
+		token = resp.ListRecords.Token
+	}
+	t, err := time.Parse("2006-01-02T15:04:05Z", strings.TrimSpace(token.ExpirationDate))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// isBadResumptionToken reports whether err is a badResumptionToken error.
+func isBadResumptionToken(err error) bool {
+	e, ok := err.(OAIError)
+	return ok && e.Code == "badResumptionToken"
+}
@@ -22,12 +22,25 @@
 package oaimi
 
 import (
+	"bytes"
+	"context"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"net/url"
 	"path"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/jinzhu/now"
+)
+
+// GranularityDay and GranularitySecond are the two datestamp granularities a
+// repository may support (3.3.2 UTCdatetime).
+const (
+	GranularityDay    = "YYYY-MM-DD"
+	GranularitySecond = "YYYY-MM-DDThh:mm:ssZ"
 )
 
 var (
@@ -39,6 +52,12 @@ var (
 	ErrMissingFromOrUntil = errors.New("missing from or until")
 	// ErrTooManyRequests might be encountered with broken resumptiontoken implementations.
 	ErrTooManyRequests = errors.New("too many requests")
+	// ErrServiceUnavailable is returned, if a repository is still unavailable
+	// after all retries.
+	ErrServiceUnavailable = errors.New("service unavailable")
+	// ErrNoCacheDir is returned for operations on cache directories, if the
+	// shards are kept in a store, that is not a directory.
+	ErrNoCacheDir = errors.New("store has no cache dir")
 
 	// Verbose logs actions
 	Verbose = false
@@ -52,6 +71,17 @@ var (
 	DefaultFormat = "oai_dc"
 	// DefaultCacheDir
 	DefaultCacheDir = ".oaimicache"
+	// DefaultMaxShardRecords is the number of records, above which adaptive
+	// harvesting splits a window further.
+	DefaultMaxShardRecords = 50000
+	// DefaultGrace is the time after the end of a window, during which a
+	// repository might still add records with a datestamp inside the window.
+	DefaultGrace = 24 * time.Hour
+	// DefaultMaxRetries is the number of times a failed request is repeated.
+	DefaultMaxRetries = 8
+	// DefaultMaxRetryAfter caps the time to wait before a retry, as
+	// requested by a repository with Retry-After.
+	DefaultMaxRetryAfter = 1 * time.Hour
 	// DefaultClient should suffice for most use cases.
 	DefaultClient = NewClient()
 	// OAIVerbMap (4. Protocol Requests and Responses)
@@ -86,26 +116,108 @@ type Request struct {
 	Prefix          string
 	Identifier      string
 	ResumptionToken string
+	// Granularity of from and until, as reported by Identify. Day granularity
+	// is used, if empty.
+	Granularity string
+}
+
+// datestampLayout returns the time layout for from and until.
+func (r *Request) datestampLayout() string {
+	if r.Granularity == GranularitySecond {
+		return "2006-01-02T15:04:05Z"
+	}
+	return "2006-01-02"
+}
+
+// ParseDatestamp parses a datestamp of day or second granularity, e.g.
+// 2015-01-01 or 2015-01-01T12:00:00Z.
+func ParseDatestamp(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == len("2006-01-02") {
+		return time.Parse("2006-01-02", s)
+	}
+	return time.Parse("2006-01-02T15:04:05Z", s)
+}
+
+// ParseUntil is like ParseDatestamp, but a datestamp of day granularity
+// denotes the end of the day, as it does for until in a request.
+func ParseUntil(s string) (time.Time, error) {
+	t, err := ParseDatestamp(s)
+	if err != nil || len(strings.TrimSpace(s)) != len("2006-01-02") {
+		return t, err
+	}
+	return now.New(t).EndOfDay(), nil
+}
+
+// identifyCache keeps the Identify responses of endpoints, so defaults are
+// looked up only once per endpoint and process.
+var identifyCache = struct {
+	sync.Mutex
+	m map[string]Identify
+}{m: make(map[string]Identify)}
+
+// identify returns the Identify response of an endpoint. Failed requests are
+// not cached.
+func identify(ctx context.Context, endpoint string) (Identify, error) {
+	identifyCache.Lock()
+	id, ok := identifyCache.m[endpoint]
+	identifyCache.Unlock()
+	if ok {
+		return id, nil
+	}
+	resp, err := DefaultClient.DoContext(ctx, Request{Verb: "Identify", Endpoint: endpoint})
+	if err != nil {
+		return resp.Identify, err
+	}
+	identifyCache.Lock()
+	identifyCache.m[endpoint] = resp.Identify
+	identifyCache.Unlock()
+	return resp.Identify, nil
 }
 
-// UseDefaults will fill in default values for From, Until and Prefix if they
-// are missing.
+// wholeDay reports whether t is the beginning or the end of a day, which can
+// be expressed with day granularity.
+func wholeDay(t time.Time) bool {
+	return t.Equal(now.New(t).BeginningOfDay()) || t.Equal(now.New(t).EndOfDay())
+}
+
+// UseDefaults will fill in default values for From, Until, Prefix and
+// Granularity if they are missing.
 func (r *Request) UseDefaults() {
-	if r.From.IsZero() {
-		req := Request{Verb: "Identify", Endpoint: r.Endpoint}
-		resp, err := DefaultClient.Do(req)
+	r.UseDefaultsContext(context.Background())
+}
+
+// UseDefaultsContext is like UseDefaults, but the Identify request, that might
+// be necessary to find the earliest datestamp or the granularity, can be
+// cancelled. Identify is not requested, if from is given and from and until
+// fall on whole days, since every repository supports day granularity.
+func (r *Request) UseDefaultsContext(ctx context.Context) {
+	if r.Granularity == "" && !r.From.IsZero() && wholeDay(r.From) && (r.Until.IsZero() || wholeDay(r.Until)) {
+		r.Granularity = GranularityDay
+	}
+	if r.From.IsZero() || r.Granularity == "" {
+		id, err := identify(ctx, r.Endpoint)
+		if r.Granularity == "" {
+			switch strings.TrimSpace(id.Granularity) {
+			case GranularitySecond:
+				r.Granularity = GranularitySecond
+			default:
+				r.Granularity = GranularityDay
+			}
+		}
 		switch {
-		case err != nil, resp.Identify.EarliestDatestamp == "", len(resp.Identify.EarliestDatestamp) < 10:
+		case !r.From.IsZero():
+		case err != nil, id.EarliestDatestamp == "", len(id.EarliestDatestamp) < 10:
 			r.From = DefaultEarliestDate
 		default:
-			r.From, err = time.Parse("2006-01-02", resp.Identify.EarliestDatestamp[:10])
+			r.From, err = time.Parse("2006-01-02", id.EarliestDatestamp[:10])
 			if err != nil || r.From.Before(CutoffDate) {
 				r.From = DefaultEarliestDate
 			}
 		}
 	}
 	if r.Until.IsZero() {
-		r.Until = time.Now()
+		r.Until = now.New(time.Now()).EndOfDay()
 	}
 	if r.Prefix == "" {
 		r.Prefix = DefaultFormat
@@ -139,9 +251,13 @@ func (r *Request) URL() (s string, err error) {
 	maybeAdd := func(k string, v interface{}) {
 		switch val := v.(type) {
 		case time.Time:
-			if !val.IsZero() {
-				values.Add(k, val.Format("2006-01-02"))
+			if val.IsZero() {
+				break
 			}
+			if r.Granularity == GranularitySecond {
+				val = val.UTC()
+			}
+			values.Add(k, val.Format(r.datestampLayout()))
 		case string:
 			if val != "" {
 				values.Add(k, val)
@@ -154,13 +270,11 @@ func (r *Request) URL() (s string, err error) {
 	case "ListRecords", "ListIdentifiers":
 		maybeAdd("from", r.From)
 		maybeAdd("until", r.Until)
-		switch r.Verb {
-		case "ListRecords":
-			maybeAdd("set", r.Set)
-			maybeAdd("metadataPrefix", r.Prefix)
-		}
+		maybeAdd("set", r.Set)
+		maybeAdd("metadataPrefix", r.Prefix)
 	case "GetRecord":
 		maybeAdd("identifier", r.Identifier)
+		maybeAdd("metadataPrefix", r.Prefix)
 	}
 	return fmt.Sprintf("%s?%s", r.Endpoint, values.Encode()), nil
 }
@@ -181,8 +295,8 @@ func makeCachePath(req Request) (string, error) {
 		case req.From.IsZero() || req.Until.IsZero():
 			return "", ErrMissingFromOrUntil
 		default:
-			return path.Join(ref.Host, ref.Path, req.Verb, req.Prefix,
-				fmt.Sprintf("%s-%s.xml", req.From.Format("2006-01-02"), req.Until.Format("2006-01-02"))), nil
+			return path.Join(ref.Host, ref.Path, req.Verb, req.Prefix, setDir(req.Set),
+				shardName(req)+".xml"), nil
 		}
 	case "Identify":
 		return path.Join(ref.Host, ref.Path, req.Verb, "Identify"), nil
@@ -190,6 +304,46 @@ func makeCachePath(req Request) (string, error) {
 	return "", ErrCannotCreatePath
 }
 
+// shardName returns the base name of a cache file for the window of a given
+// request, without extension. Windows are named by their first and last day.
+// With second granularity, a window that does not start at the beginning and
+// end at the end of a day is named by its UTC bounds down to the second, e.g.
+// 2015-01-01T120000Z-2015-01-01T235959Z.
+func shardName(req Request) string {
+	from, until := req.From, req.Until
+	aligned := from.Equal(now.New(from).BeginningOfDay()) && until.Equal(now.New(until).EndOfDay())
+	if req.Granularity == GranularitySecond && !aligned {
+		layout := "2006-01-02T150405Z"
+		return fmt.Sprintf("%s-%s", from.UTC().Format(layout), until.UTC().Format(layout))
+	}
+	return fmt.Sprintf("%s-%s", from.Format("2006-01-02"), until.Format("2006-01-02"))
+}
+
+// setDir turns a set spec into a single path component, prefixed with "set-",
+// so it cannot be confused with a shard file name. Bytes outside of
+// [A-Za-z0-9-_.~] are percent-encoded, which keeps hierarchical specs like
+// a:b:c in a single directory (set-a%3Ab%3Ac). An empty spec yields an empty
+// string, so requests without a set keep the original layout.
+func setDir(spec string) string {
+	if spec == "" {
+		return ""
+	}
+	var buf bytes.Buffer
+	buf.WriteString("set-")
+	for i := 0; i < len(spec); i++ {
+		c := spec[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+			buf.WriteByte(c)
+		case c == '-', c == '_', c == '.', c == '~':
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
 // resumptionToken is part of OAI flow control (3.5)
 type resumptionToken struct {
 	//
@@ -197,23 +351,30 @@ type resumptionToken struct {
 	// The following optional attributes may be included as part of the
 	// resumptionToken element along with the resumptionToken itself. A
 	// UTCdatetime indicating when the resumptionToken ceases to be valid.
-	ExpirationDate string `xml:"expirationDate"`
+	ExpirationDate string `xml:"expirationDate,attr,omitempty"`
 	// A count of the number of elements of the complete list thus far
 	// returned (i.e. cursor starts at 0).
-	Cursor string `xml:"cursor,attr"`
+	Cursor string `xml:"cursor,attr,omitempty"`
 	// An integer indicating the cardinality of the complete list. The value
 	// of completeListSize may be only an estimate of the actual cardinality
 	// of the complete list and may be revised during the list request
 	// sequence.
-	CompleteListSize string `xml:"completeListSize,attr"`
+	CompleteListSize string `xml:"completeListSize,attr,omitempty"`
 }
 
 // header is the main response of ListIdentifiers requests and also
 // transmitted in ListRecords.
 type header struct {
-	Identifier string `xml:"identifier"`
-	Datestamp  string `xml:"datestamp"`
-	Set        string `xml:"setSpec"`
+	// Status is "deleted" for deleted records and empty otherwise.
+	Status     string   `xml:"status,attr,omitempty"`
+	Identifier string   `xml:"identifier"`
+	Datestamp  string   `xml:"datestamp"`
+	SetSpec    []string `xml:"setSpec"`
+}
+
+// Deleted reports whether the record has been deleted from the repository.
+func (h header) Deleted() bool {
+	return h.Status == "deleted"
 }
 
 // Identify response.
@@ -236,12 +397,40 @@ type Identify struct {
 	} `xml:"description,omitempty" json:"description,omitempty"`
 }
 
+// MarshalXML leaves out an empty description, which would not be valid.
+func (id Identify) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	v := struct {
+		Name              string      `xml:"repositoryName"`
+		URL               string      `xml:"baseURL"`
+		Version           string      `xml:"protocolVersion"`
+		AdminEmail        string      `xml:"adminEmail"`
+		EarliestDatestamp string      `xml:"earliestDatestamp"`
+		DeletePolicy      string      `xml:"deletedRecord"`
+		Granularity       string      `xml:"granularity"`
+		Description       interface{} `xml:"description,omitempty"`
+	}{
+		Name:              id.Name,
+		URL:               id.URL,
+		Version:           id.Version,
+		AdminEmail:        id.AdminEmail,
+		EarliestDatestamp: id.EarliestDatestamp,
+		DeletePolicy:      id.DeletePolicy,
+		Granularity:       id.Granularity,
+	}
+	d := id.Description
+	if len(d.Friends) > 0 || d.Identifier.Scheme != "" || d.Identifier.RepositoryIdentifier != "" {
+		v.Description = d
+	}
+	return e.EncodeElement(v, start)
+}
+
 // ListMetadataFormats response.
 type ListMetadataFormats struct {
 	xml.Name `xml:"ListMetadataFormats" json:"formats"`
 	Formats  []struct {
-		Prefix string `xml:"metadataPrefix" json:"prefix"`
-		Schema string `xml:"schema" json:"schema"`
+		Prefix    string `xml:"metadataPrefix" json:"prefix"`
+		Schema    string `xml:"schema" json:"schema"`
+		Namespace string `xml:"metadataNamespace" json:"namespace,omitempty"`
 	} `xml:"metadataFormat" json:"format"`
 }
 
@@ -250,7 +439,7 @@ type ListSets struct {
 	Sets []struct {
 		Spec        string `xml:"setSpec" json:"spec,omitempty"`
 		Name        string `xml:"setName" json:"name,omitempty"`
-		Description string `xml:"setDescription>dc>description" json:"description,omitempty"`
+		Description string `xml:"setDescription>dc>description,omitempty" json:"description,omitempty"`
 	} `xml:"set" json:"set"`
 	Token resumptionToken `xml:"resumptionToken"`
 }
@@ -261,15 +450,113 @@ type ListIdentifiers struct {
 	Token  resumptionToken `xml:"resumptionToken"`
 }
 
+// Record is a single record, as transmitted in ListRecords and GetRecord.
+type Record struct {
+	XMLName  xml.Name `xml:"record"`
+	Header   header   `xml:"header"`
+	Metadata struct {
+		Verbatim string `xml:",innerxml"`
+	} `xml:"metadata"`
+	// About is an optional and repeatable container, which holds data about
+	// the metadata part of the record (2.5 Record).
+	About []About `xml:"about"`
+}
+
+// About is an about container of a record, e.g. with provenance or rights
+// statements. Common statements are parsed, the verbatim content is kept.
+type About struct {
+	Verbatim string `xml:",innerxml"`
+	// Provenance describes the origin of a record, that has been harvested
+	// from another repository (http://www.openarchives.org/OAI/2.0/provenance).
+	Provenance *struct {
+		Origins []Origin `xml:"originDescription"`
+	} `xml:"provenance"`
+	// Rights holds rights statements, either by reference or inline
+	// (http://www.openarchives.org/OAI/2.0/rights/).
+	Rights *struct {
+		References []struct {
+			Ref string `xml:"ref,attr"`
+		} `xml:"rightsReference"`
+		Definition struct {
+			Verbatim string `xml:",innerxml"`
+		} `xml:"rightsDefinition"`
+	} `xml:"rights"`
+}
+
+// Origin describes a repository, a record has been harvested from. Origins
+// nest, if the record has been harvested more than once.
+type Origin struct {
+	HarvestDate       string  `xml:"harvestDate,attr" json:"harvestDate,omitempty"`
+	Altered           bool    `xml:"altered,attr" json:"altered"`
+	BaseURL           string  `xml:"baseURL" json:"baseURL,omitempty"`
+	Identifier        string  `xml:"identifier" json:"identifier,omitempty"`
+	Datestamp         string  `xml:"datestamp" json:"datestamp,omitempty"`
+	MetadataNamespace string  `xml:"metadataNamespace" json:"metadataNamespace,omitempty"`
+	Origin            *Origin `xml:"originDescription" json:"origin,omitempty"`
+}
+
+// Origins returns the provenance of a record, outermost first.
+func (r Record) Origins() []Origin {
+	var origins []Origin
+	for _, a := range r.About {
+		if a.Provenance != nil {
+			origins = append(origins, a.Provenance.Origins...)
+		}
+	}
+	return origins
+}
+
+// RightsReferences returns the URLs of all referenced rights statements.
+func (r Record) RightsReferences() []string {
+	var refs []string
+	for _, a := range r.About {
+		if a.Rights == nil {
+			continue
+		}
+		for _, ref := range a.Rights.References {
+			refs = append(refs, ref.Ref)
+		}
+	}
+	return refs
+}
+
+// HasAbout reports whether an about container of the record contains the
+// given text, e.g. the URL of a rights statement.
+func (r Record) HasAbout(s string) bool {
+	for _, a := range r.About {
+		if strings.Contains(a.Verbatim, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// MarshalXML leaves out the empty metadata element of deleted records.
+func (r Record) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	v := struct {
+		Header   header      `xml:"header"`
+		Metadata interface{} `xml:"metadata,omitempty"`
+		About    []struct {
+			Verbatim string `xml:",innerxml"`
+		} `xml:"about"`
+	}{Header: r.Header}
+	// only the verbatim content, parsed statements are part of it
+	for _, a := range r.About {
+		v.About = append(v.About, struct {
+			Verbatim string `xml:",innerxml"`
+		}{a.Verbatim})
+	}
+	if !r.Header.Deleted() || r.Metadata.Verbatim != "" {
+		v.Metadata = r.Metadata
+	}
+	start.Name = xml.Name{Local: "record"}
+	return e.EncodeElement(v, start)
+}
+
 // ListRecords response.
 type ListRecords struct {
-	Records []struct {
-		Header   header `xml:"header"`
-		Metadata struct {
-			Verbatim string `xml:",innerxml"`
-		} `xml:"metadata"`
-	} `xml:"record"`
-	Token resumptionToken `xml:"resumptionToken"`
+	Records []Record        `xml:"record"`
+	Token   resumptionToken `xml:"resumptionToken"`
 }
 
 // Response can hold most answers to an request to a OAI server.
@@ -289,4 +576,7 @@ type Response struct {
 	ListSets            ListSets            `xml:"ListSets,omitempty" json:"sets"`
 	ListRecords         ListRecords         `xml:"ListRecords,omitempty"`
 	Identify            Identify            `xml:"Identify,omitempty" json:"identity,omitempty"`
+	GetRecord           struct {
+		Record Record `xml:"record"`
+	} `xml:"GetRecord,omitempty"`
 }
@@ -22,8 +22,11 @@
 package oaimi
 
 import (
+	"context"
 	"testing"
 	"time"
+
+	"github.com/miku/oaimi/oaitest"
 )
 
 func TestRequestURL(t *testing.T) {
@@ -37,6 +40,10 @@ func TestRequestURL(t *testing.T) {
 		{Request{Endpoint: "Hello", Verb: "x"}, "", ErrBadVerb},
 		{Request{Endpoint: "Hello", Verb: "Identify"}, "Hello?verb=Identify", nil},
 		{Request{Endpoint: "http://example.com/oai", Verb: "Identify"}, "http://example.com/oai?verb=Identify", nil},
+		{Request{Endpoint: "http://example.com/oai", Verb: "ListIdentifiers", Set: "X", Prefix: "P"},
+			"http://example.com/oai?metadataPrefix=P&set=X&verb=ListIdentifiers", nil},
+		{Request{Endpoint: "http://example.com/oai", Verb: "GetRecord", Identifier: "oai:x:1", Prefix: "oai_dc"},
+			"http://example.com/oai?identifier=oai%3Ax%3A1&metadataPrefix=oai_dc&verb=GetRecord", nil},
 		{Request{Endpoint: "http://example.com/oai",
 			Verb: "Identify",
 			From: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
@@ -57,6 +64,19 @@ func TestRequestURL(t *testing.T) {
 		{Request{Endpoint: "http://example.com/oai",
 			Verb: "ListRecords", Set: "X", Prefix: "P", ResumptionToken: "R"},
 			"http://example.com/oai?resumptionToken=R&verb=ListRecords", nil},
+		{Request{Endpoint: "http://example.com/oai", Verb: "ListRecords",
+			From:        time.Date(2000, 1, 1, 10, 0, 0, 0, time.UTC),
+			Until:       time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC),
+			Granularity: GranularitySecond},
+			"http://example.com/oai?from=2000-01-01T10%3A00%3A00Z&until=2000-01-02T00%3A00%3A00Z&verb=ListRecords", nil},
+		{Request{Endpoint: "http://example.com/oai", Verb: "ListRecords",
+			From:        time.Date(2000, 1, 1, 10, 0, 0, 0, time.FixedZone("X", 3600)),
+			Granularity: GranularitySecond},
+			"http://example.com/oai?from=2000-01-01T09%3A00%3A00Z&verb=ListRecords", nil},
+		{Request{Endpoint: "http://example.com/oai", Verb: "ListRecords",
+			From:        time.Date(2000, 1, 1, 10, 0, 0, 0, time.UTC),
+			Granularity: GranularityDay},
+			"http://example.com/oai?from=2000-01-01&verb=ListRecords", nil},
 	}
 
 	for _, test := range tests {
@@ -86,6 +106,17 @@ func TestMakeCachePath(t *testing.T) {
 			"www.doabooks.org/oai/ListRecords/marcxml/2000-01-01-2001-01-01.xml",
 			nil,
 		},
+		{
+			Request{
+				Verb:     "ListRecords",
+				Endpoint: "http://www.doabooks.org/oai",
+				From:     time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+				Until:    time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC),
+				Prefix:   "marcxml",
+				Set:      "ddc:300"},
+			"www.doabooks.org/oai/ListRecords/marcxml/set-ddc%3A300/2000-01-01-2001-01-01.xml",
+			nil,
+		},
 		{
 			Request{
 				Verb:     "ListRecords",
@@ -113,3 +144,103 @@ func TestMakeCachePath(t *testing.T) {
 		}
 	}
 }
+
+func TestSetDir(t *testing.T) {
+	var tests = []struct {
+		spec string
+		dir  string
+	}{
+		{"", ""},
+		{"ulbdvester", "set-ulbdvester"},
+		{"a:b:c", "set-a%3Ab%3Ac"},
+		{"..", "set-.."},
+		{"x/y", "set-x%2Fy"},
+		{"(100%)", "set-%28100%25%29"},
+	}
+	for _, test := range tests {
+		if got := setDir(test.spec); got != test.dir {
+			t.Errorf("setDir(%q) got %v, want %v", test.spec, got, test.dir)
+		}
+	}
+}
+
+func TestShardName(t *testing.T) {
+	var tests = []struct {
+		req  Request
+		name string
+	}{
+		{Request{
+			From:  time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+			Until: time.Date(2000, 1, 7, 23, 59, 59, 999999999, time.UTC)},
+			"2000-01-01-2000-01-07"},
+		{Request{
+			From:  time.Date(2000, 1, 1, 12, 0, 0, 0, time.UTC),
+			Until: time.Date(2000, 1, 7, 23, 59, 59, 999999999, time.UTC)},
+			"2000-01-01-2000-01-07"},
+		{Request{
+			From:        time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+			Until:       time.Date(2000, 1, 7, 23, 59, 59, 999999999, time.UTC),
+			Granularity: GranularitySecond},
+			"2000-01-01-2000-01-07"},
+		{Request{
+			From:        time.Date(2000, 1, 1, 12, 30, 5, 0, time.UTC),
+			Until:       time.Date(2000, 1, 7, 23, 59, 59, 999999999, time.UTC),
+			Granularity: GranularitySecond},
+			"2000-01-01T123005Z-2000-01-07T235959Z"},
+	}
+	for _, test := range tests {
+		if got := shardName(test.req); got != test.name {
+			t.Errorf("shardName() got %v, want %v", got, test.name)
+		}
+	}
+}
+
+func TestParseUntil(t *testing.T) {
+	var tests = []struct {
+		s     string
+		until time.Time
+	}{
+		{"2015-01-01", time.Date(2015, 1, 1, 23, 59, 59, 999999999, time.UTC)},
+		{"2015-01-01T12:00:00Z", time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		until, err := ParseUntil(test.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !until.Equal(test.until) {
+			t.Errorf("ParseUntil(%s) got %v, want %v", test.s, until, test.until)
+		}
+	}
+}
+
+func TestUseDefaults(t *testing.T) {
+	ts := oaitest.NewServer(oaitest.Config{Records: testRecords(3), Granularity: oaitest.GranularitySecond})
+	defer ts.Close()
+
+	// whole days need no Identify
+	req := Request{
+		Endpoint: ts.URL,
+		From:     time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		Until:    time.Date(2000, 1, 31, 0, 0, 0, 0, time.UTC),
+	}
+	req.UseDefaults()
+	if req.Granularity != GranularityDay || ts.Requests() != 0 {
+		t.Errorf("UseDefaults() got %s after %d requests, want day granularity without requests",
+			req.Granularity, ts.Requests())
+	}
+	// the Identify response is reused
+	for i := 0; i < 2; i++ {
+		req := Request{Endpoint: ts.URL}
+		req.UseDefaultsContext(context.Background())
+		if req.Granularity != GranularitySecond {
+			t.Errorf("UseDefaults() got %s, want %s", req.Granularity, GranularitySecond)
+		}
+		if !req.From.Equal(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("UseDefaults() got from %v", req.From)
+		}
+	}
+	if ts.Requests() != 1 {
+		t.Errorf("UseDefaults() got %d requests, want 1", ts.Requests())
+	}
+}
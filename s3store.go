@@ -0,0 +1,372 @@
+//  Copyright 2015 by Leipzig University Library, http://ub.uni-leipzig.de
+//                    The Finc Authors, http://finc.info
+//                    Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+//
+package oaimi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 of an empty request body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Store keeps shards in a bucket of an S3-compatible object store, like
+// MinIO, with path-style requests. Values are stored gzip compressed. Requests
+// are signed with AWS Signature Version 4, if an access key is given. Shards
+// are not locked, so processes sharing a bucket may retrieve a shard twice and
+// overwrite each others manifest updates.
+type S3Store struct {
+	// Endpoint is the URL of the object store, e.g. http://localhost:9000.
+	Endpoint string
+	Bucket   string
+	// Prefix is prepended to all keys, e.g. to share a bucket.
+	Prefix    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	// Client defaults to http.DefaultClient.
+	Client HttpRequestDoer
+}
+
+// NewS3Store returns a store for a bucket, in region us-east-1.
+func NewS3Store(endpoint, bucket string) *S3Store {
+	return &S3Store{Endpoint: strings.TrimRight(endpoint, "/"), Bucket: bucket, Region: "us-east-1"}
+}
+
+// object returns the object name of a key.
+func (s *S3Store) object(key string) string {
+	if s.Prefix == "" {
+		return key
+	}
+	return strings.Trim(s.Prefix, "/") + "/" + key
+}
+
+// do sends a signed request for an object or, with an empty object name, for
+// the bucket.
+func (s *S3Store) do(method, object string, query url.Values, body io.ReadSeeker, size int64) (*http.Response, error) {
+	link := s.Endpoint + "/" + s.Bucket
+	if object != "" {
+		link += "/" + uriEncode(object, false)
+	}
+	req, err := http.NewRequest(method, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawQuery = query.Encode()
+	payloadHash := emptyPayloadHash
+	if body != nil {
+		h := sha256.New()
+		if _, err := io.Copy(h, body); err != nil {
+			return nil, err
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		payloadHash = hex.EncodeToString(h.Sum(nil))
+		req.Body, req.ContentLength = ioutil.NopCloser(body), size
+	}
+	req.Header.Set("User-Agent", UserAgent)
+	s.sign(req, payloadHash, time.Now())
+	var client HttpRequestDoer = http.DefaultClient
+	if s.Client != nil {
+		client = s.Client
+	}
+	return client.Do(req)
+}
+
+// sign adds an AWS Signature Version 4 to a request. The host and all headers
+// of the request, except the User-Agent, are signed.
+func (s *S3Store) sign(req *http.Request, payloadHash string, t time.Time) {
+	if s.AccessKey == "" {
+		return
+	}
+	amzdate := t.UTC().Format("20060102T150405Z")
+	day := amzdate[:8]
+	req.Header.Set("X-Amz-Date", amzdate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, vs := range req.Header {
+		if k == "User-Agent" {
+			continue
+		}
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(vs, ","))
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", k, headers[k])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	var query []string
+	for k, vs := range req.URL.Query() {
+		for _, v := range vs {
+			query = append(query, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(query)
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		strings.Join(query, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzdate, scope, hexSHA256(canonicalRequest)}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), day)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data string) string {
+	h := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(h[:])
+}
+
+// uriEncode percent-encodes all bytes except unreserved characters, and
+// slashes, unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			buf.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// s3Error turns an unexpected response into an error.
+func s3Error(resp *http.Response) error {
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3: %s %s: %s: %s", resp.Request.Method, resp.Request.URL.Path,
+		resp.Status, bytes.TrimSpace(b))
+}
+
+func (s *S3Store) Exists(key string) (time.Time, bool, error) {
+	resp, err := s.do("HEAD", s.object(key), nil, nil, 0)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		return modified, true, nil
+	case http.StatusNotFound:
+		return time.Time{}, false, nil
+	}
+	return time.Time{}, false, s3Error(resp)
+}
+
+// Size returns the size of the compressed object.
+func (s *S3Store) Size(key string) (int64, error) {
+	resp, err := s.do("HEAD", s.object(key), nil, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength, nil
+	case http.StatusNotFound:
+		return 0, &os.PathError{Op: "size", Path: key, Err: os.ErrNotExist}
+	}
+	return 0, s3Error(resp)
+}
+
+// s3Reader closes the decompressor and the response body.
+type s3Reader struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (r s3Reader) Close() error {
+	r.Reader.Close()
+	return r.body.Close()
+}
+
+func (s *S3Store) Open(key string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", s.object(key), nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		return s3Reader{Reader: gz, body: resp.Body}, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, &os.PathError{Op: "open", Path: key, Err: os.ErrNotExist}
+	}
+	defer resp.Body.Close()
+	return nil, s3Error(resp)
+}
+
+func (s *S3Store) Create(key string) (ShardWriter, error) {
+	tf, err := ioutil.TempFile("", "s3store-")
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{store: s, key: key, tempfile: tf, gz: gzip.NewWriter(tf)}, nil
+}
+
+// listBucketResult is the response to a ListObjectsV2 request.
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3Store) List(prefix string) ([]string, error) {
+	var keys []string
+	strip := len(s.object(""))
+	query := url.Values{"list-type": {"2"}, "prefix": {s.object(listPrefix(prefix))}}
+	for {
+		resp, err := s.do("GET", "", query, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			defer resp.Body.Close()
+			return nil, s3Error(resp)
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key[strip:])
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *S3Store) Delete(key string) error {
+	resp, err := s.do("DELETE", s.object(key), nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	return s3Error(resp)
+}
+
+// s3Writer compresses a value into a temporary file, which is uploaded on
+// Close.
+type s3Writer struct {
+	store    *S3Store
+	key      string
+	tempfile *os.File
+	gz       *gzip.Writer
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.gz.Write(p)
+}
+
+func (w *s3Writer) Close() error {
+	defer os.Remove(w.tempfile.Name())
+	defer w.tempfile.Close()
+	if err := w.gz.Close(); err != nil {
+		return err
+	}
+	size, err := w.tempfile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := w.tempfile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	resp, err := w.store.do("PUT", w.store.object(w.key), nil, w.tempfile, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (w *s3Writer) Abort() error {
+	w.tempfile.Close()
+	return os.Remove(w.tempfile.Name())
+}
@@ -0,0 +1,185 @@
+//  Copyright 2015 by Leipzig University Library, http://ub.uni-leipzig.de
+//                    The Finc Authors, http://finc.info
+//                    Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+//
+package oaimi
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+)
+
+// encodingDecl finds the encoding in an XML declaration.
+var encodingDecl = regexp.MustCompile(`encoding\s*=\s*["']([A-Za-z0-9._-]+)["']`)
+
+// charRef matches the rest of a character reference after the ampersand.
+var charRef = regexp.MustCompile(`^#(x[0-9A-Fa-f]+|[0-9]+);`)
+
+// maxCharRef is the length of the longest character reference, that is
+// looked at, without ampersand; longer ones are left alone.
+const maxCharRef = 16
+
+// Repairs reports, what has been changed in a response to make it well-formed.
+type Repairs struct {
+	// URL of the request.
+	URL string `json:"url"`
+	// Encoding is the declared encoding, if the response has been converted to
+	// UTF-8.
+	Encoding string `json:"encoding,omitempty"`
+	// IllegalChars is the number of characters and character references
+	// removed, that are not allowed in XML, e.g. most control characters.
+	IllegalChars int `json:"illegal,omitempty"`
+	// InvalidUTF8 is the number of byte sequences replaced with U+FFFD, that
+	// are not valid UTF-8.
+	InvalidUTF8 int `json:"invalid,omitempty"`
+}
+
+// Repaired reports whether anything has been changed.
+func (r Repairs) Repaired() bool {
+	return r.Encoding != "" || r.IllegalChars > 0 || r.InvalidUTF8 > 0
+}
+
+func (r Repairs) String() string {
+	return fmt.Sprintf("%s: encoding=%q illegal=%d invalid=%d", r.URL, r.Encoding, r.IllegalChars, r.InvalidUTF8)
+}
+
+// isXMLChar reports whether a rune is allowed in XML 1.0 documents (2.2).
+func isXMLChar(r rune) bool {
+	return r == 0x09 || r == 0x0A || r == 0x0D ||
+		(r >= 0x20 && r <= 0xD7FF) ||
+		(r >= 0xE000 && r <= 0xFFFD) ||
+		(r >= 0x10000 && r <= 0x10FFFF)
+}
+
+// sanitizer turns a response into well-formed UTF-8: A response in a
+// supported legacy encoding is converted, with the XML declaration adjusted.
+// Characters not allowed in XML and character references to them are
+// removed, invalid UTF-8 is replaced.
+type sanitizer struct {
+	rc      io.ReadCloser
+	r       *bufio.Reader
+	pending []byte
+	repairs Repairs
+	// report is called on Close, if anything has been repaired.
+	report func(Repairs)
+}
+
+// newSanitizer wraps a response body.
+func newSanitizer(rc io.ReadCloser, link string, report func(Repairs)) *sanitizer {
+	s := &sanitizer{rc: rc, repairs: Repairs{URL: link}, report: report}
+	br := bufio.NewReader(rc)
+	s.r = br
+	head, _ := br.Peek(512)
+	if !bytes.HasPrefix(head, []byte("<?xml")) {
+		return s
+	}
+	end := bytes.Index(head, []byte("?>"))
+	if end < 0 {
+		return s
+	}
+	decl := head[:end+2]
+	m := encodingDecl.FindSubmatchIndex(decl)
+	if m == nil {
+		return s
+	}
+	label := string(decl[m[2]:m[3]])
+	if isUTF8(label) {
+		return s
+	}
+	if _, ok := charsetTable(label); !ok {
+		return s
+	}
+	var fixed bytes.Buffer
+	fixed.Write(decl[:m[2]])
+	fixed.WriteString("UTF-8")
+	fixed.Write(decl[m[3]:])
+	br.Discard(len(decl))
+	converted, _ := CharsetReader(label, br)
+	s.r = bufio.NewReader(io.MultiReader(&fixed, converted))
+	s.repairs.Encoding = label
+	return s
+}
+
+func (s *sanitizer) Read(p []byte) (n int, err error) {
+	var buf [utf8.UTFMax]byte
+	for n < len(p) {
+		if len(s.pending) > 0 {
+			k := copy(p[n:], s.pending)
+			s.pending, n = s.pending[k:], n+k
+			continue
+		}
+		r, size, err := s.r.ReadRune()
+		if err != nil {
+			if n > 0 && err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+		switch {
+		case r == utf8.RuneError && size == 1:
+			s.repairs.InvalidUTF8++
+		case !isXMLChar(r):
+			s.repairs.IllegalChars++
+			continue
+		case r == '&' && s.illegalRef():
+			s.repairs.IllegalChars++
+			continue
+		}
+		k := utf8.EncodeRune(buf[:], r)
+		s.pending = append(s.pending[:0], buf[:k]...)
+	}
+	return n, nil
+}
+
+// illegalRef reports whether the input after an ampersand is a character
+// reference to a code point, that is not allowed in XML, e.g. &#x1;, which
+// is consumed then.
+func (s *sanitizer) illegalRef() bool {
+	head, _ := s.r.Peek(maxCharRef)
+	m := charRef.FindSubmatch(head)
+	if m == nil {
+		return false
+	}
+	var v uint64
+	var err error
+	if m[1][0] == 'x' {
+		v, err = strconv.ParseUint(string(m[1][1:]), 16, 32)
+	} else {
+		v, err = strconv.ParseUint(string(m[1]), 10, 32)
+	}
+	if err == nil && isXMLChar(rune(v)) {
+		return false
+	}
+	s.r.Discard(len(m[0]))
+	return true
+}
+
+// Close closes the body and reports repairs.
+func (s *sanitizer) Close() error {
+	if s.report != nil && s.repairs.Repaired() {
+		s.report(s.repairs)
+	}
+	return s.rc.Close()
+}
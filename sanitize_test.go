@@ -0,0 +1,90 @@
+package oaimi
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSanitizer(t *testing.T) {
+	var tests = []struct {
+		body    string
+		want    string
+		repairs Repairs
+	}{
+		{"<a>ok</a>", "<a>ok</a>", Repairs{URL: "u"}},
+		{"<a>b\x00e\x1bll</a>", "<a>bell</a>", Repairs{URL: "u", IllegalChars: 2}},
+		{"<a>\xffx</a>", "<a>�x</a>", Repairs{URL: "u", InvalidUTF8: 1}},
+		{"<a>b&#x1;e&#31;ll &#x41;&amp;&#9;</a>", "<a>bell &#x41;&amp;&#9;</a>", Repairs{URL: "u", IllegalChars: 2}},
+		{`<?xml version="1.0" encoding="ISO-8859-1"?><a>M` + "\xfc" + `ller</a>`,
+			`<?xml version="1.0" encoding="UTF-8"?><a>Müller</a>`,
+			Repairs{URL: "u", Encoding: "ISO-8859-1"}},
+		{`<?xml version="1.0" encoding='windows-1252'?><a>` + "\x80" + `</a>`,
+			`<?xml version="1.0" encoding='UTF-8'?><a>€</a>`,
+			Repairs{URL: "u", Encoding: "windows-1252"}},
+	}
+	for _, test := range tests {
+		var got Repairs
+		s := newSanitizer(ioutil.NopCloser(strings.NewReader(test.body)), "u", func(r Repairs) { got = r })
+		b, err := ioutil.ReadAll(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+		if string(b) != test.want {
+			t.Errorf("sanitize(%q) got %q, want %q", test.body, b, test.want)
+		}
+		if test.repairs.Repaired() && got != test.repairs {
+			t.Errorf("sanitize(%q) repairs got %+v, want %+v", test.body, got, test.repairs)
+		}
+	}
+}
+
+func TestCharsetReader(t *testing.T) {
+	body := `<?xml version="1.0" encoding="ISO-8859-15"?><a>` + "\xa4" + `</a>`
+	dec := xml.NewDecoder(strings.NewReader(body))
+	dec.CharsetReader = CharsetReader
+	var v struct {
+		Value string `xml:",chardata"`
+	}
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Value != "€" {
+		t.Errorf("got %q, want %q", v.Value, "€")
+	}
+	if _, err := CharsetReader("ebcdic", strings.NewReader("")); err == nil {
+		t.Errorf("CharsetReader(ebcdic) got nil error")
+	}
+}
+
+func TestClientSanitize(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<OAI-PMH><request verb="ListRecords">x</request><ListRecords><record>`+
+			`<header><identifier>a</identifier><datestamp>2000-01-01</datestamp></header>`+
+			`<metadata><title>Bell&#x1;</title></metadata></record></ListRecords></OAI-PMH>`)
+	}))
+	defer ts.Close()
+
+	req := Request{Endpoint: ts.URL, Verb: "ListRecords", Prefix: "oai_dc"}
+	client := NewClientDoer(http.DefaultClient)
+	if _, err := client.Do(req); err == nil {
+		t.Fatalf("Do() without Sanitize got nil error")
+	}
+	var repairs Repairs
+	client.Sanitize, client.Report = true, func(r Repairs) { repairs = r }
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.ListRecords.Records[0].Metadata.Verbatim; got != "<title>Bell</title>" {
+		t.Errorf("got %q, want %q", got, "<title>Bell</title>")
+	}
+	if repairs.IllegalChars != 1 {
+		t.Errorf("got %d illegal chars, want 1", repairs.IllegalChars)
+	}
+}
@@ -0,0 +1,258 @@
+//  Copyright 2015 by Leipzig University Library, http://ub.uni-leipzig.de
+//                    The Finc Authors, http://finc.info
+//                    Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+//
+package oaimi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+)
+
+// position identifies a record by shard and offset within the shard.
+type position struct {
+	shard  int
+	offset int
+}
+
+// latest tracks the position and datestamp of the latest version of a record.
+type latest struct {
+	position
+	datestamp string
+	deleted   bool
+}
+
+// legacyRoot starts the pages in shards written by older versions, which
+// stored re-serialized responses instead of the response bodies.
+const legacyRoot = "<Response>"
+
+// copyShard copies shard content from r to w. The Response root elements of
+// legacy shards are renamed to OAI-PMH, so the output does not mix both. If
+// keep is not nil, records and headers are left out, see cutItems.
+func copyShard(w io.Writer, r io.Reader, keep func(header) bool) error {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(len(legacyRoot))
+	legacy := string(head) == legacyRoot
+	if !legacy && keep == nil {
+		_, err := io.Copy(w, br)
+		return err
+	}
+	return cutItems(w, br, keep, legacy)
+}
+
+// cutItems copies shard content from r to w and leaves out the records and
+// headers, for which keep returns false. A nil keep keeps all items. If legacy
+// is set, root elements are renamed to OAI-PMH. Everything else is copied as
+// is. Shards are UTF-8 encoded, other encodings are not supported.
+func cutItems(w io.Writer, r io.Reader, keep func(header) bool, legacy bool) error {
+	// buf holds the input from offset base on, that has not been copied yet
+	var buf bytes.Buffer
+	var base int64
+	dec := xml.NewDecoder(io.TeeReader(r, &buf))
+	advance := func(offset int64, write bool) error {
+		b := buf.Next(int(offset - base))
+		base = offset
+		if !write {
+			return nil
+		}
+		_, err := w.Write(b)
+		return err
+	}
+	// replace writes s instead of the input from start to the current offset
+	replace := func(start int64, s string) error {
+		if err := advance(start, true); err != nil {
+			return err
+		}
+		if err := advance(dec.InputOffset(), false); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, s)
+		return err
+	}
+	var depth int
+	for {
+		start := dec.InputOffset()
+		t, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var se xml.StartElement
+		switch t := t.(type) {
+		case xml.StartElement:
+			se = t
+		case xml.EndElement:
+			depth--
+			if legacy && depth == 0 {
+				if err := replace(start, "</OAI-PMH>"); err != nil {
+					return err
+				}
+			}
+			continue
+		default:
+			continue
+		}
+		if legacy && depth == 0 {
+			depth++
+			if err := replace(start, "<OAI-PMH>"); err != nil {
+				return err
+			}
+			continue
+		}
+		var h header
+		switch {
+		case keep == nil:
+			depth++
+			continue
+		case se.Name.Local == "record":
+			var rec struct {
+				Header header `xml:"header"`
+			}
+			if err := dec.DecodeElement(&rec, &se); err != nil {
+				return err
+			}
+			h = rec.Header
+		case se.Name.Local == "header":
+			if err := dec.DecodeElement(&h, &se); err != nil {
+				return err
+			}
+		default:
+			depth++
+			continue
+		}
+		if !keep(h) {
+			if err := advance(start, true); err != nil {
+				return err
+			}
+			err = advance(dec.InputOffset(), false)
+		} else {
+			err = advance(dec.InputOffset(), true)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// eachRecord calls fn for every record in the given shards, in order.
+func eachRecord(store CacheStore, keys []string, fn func(pos position, rec Record) error) error {
+	var rec Record
+	for i, key := range keys {
+		file, err := store.Open(key)
+		if err != nil {
+			return err
+		}
+		rr := newRecordReader(file)
+		for j := 0; ; j++ {
+			err := rr.next(&rec)
+			if err == io.EOF || err == errNoRecordsMatch {
+				break
+			}
+			if err != nil {
+				file.Close()
+				return err
+			}
+			if err := fn(position{shard: i, offset: j}, rec); err != nil {
+				file.Close()
+				return err
+			}
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshot calls fn with the latest version of every record found in the
+// given shards, in order of their appearance, skipping deleted records. The
+// latest version is the one with the greatest datestamp, or the one found
+// last, if datestamps are equal. Records, for which keep returns false, are
+// ignored, unless keep is nil. The shards are read twice, only identifiers
+// and positions are kept in memory.
+func snapshot(store CacheStore, keys []string, keep func(header) bool, fn func(rec Record) error) error {
+	index := make(map[string]latest)
+	err := eachRecord(store, keys, func(pos position, rec Record) error {
+		h := rec.Header
+		if keep != nil && !keep(h) {
+			return nil
+		}
+		if v, ok := index[h.Identifier]; ok && v.datestamp > h.Datestamp {
+			return nil
+		}
+		index[h.Identifier] = latest{position: pos, datestamp: h.Datestamp, deleted: h.Deleted()}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return eachRecord(store, keys, func(pos position, rec Record) error {
+		v, ok := index[rec.Header.Identifier]
+		if !ok || v.position != pos || v.deleted {
+			return nil
+		}
+		return fn(rec)
+	})
+}
+
+// Snapshot is like Do, but writes only the latest version of each record
+// within the requested range, with deletions applied.
+func (c CachingClient) Snapshot(req Request) error {
+	return c.SnapshotContext(context.Background(), req)
+}
+
+// SnapshotContext is like Snapshot, but the request can be cancelled through
+// the context.
+func (c CachingClient) SnapshotContext(ctx context.Context, req Request) error {
+	switch req.Verb {
+	case "ListRecords", "ListIdentifiers":
+	default:
+		return ErrBadVerb
+	}
+	var keys []string
+	var keep func(header) bool
+	err := c.eachShard(ctx, req, func(key string, k func(header) bool) error {
+		keys = append(keys, key)
+		if k != nil {
+			keep = k
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	write, err := c.recordWriter(req)
+	if err != nil {
+		return err
+	}
+	if c.Format == FormatJSONL || c.Format == FormatTSV {
+		c.RootTag = ""
+	}
+	c.startDocument()
+	defer c.endDocument()
+	return snapshot(c.store(), keys, keep, write)
+}
@@ -0,0 +1,92 @@
+package oaimi
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	shards := []string{
+		`<OAI-PMH><ListRecords>
+			<record><header><identifier>a</identifier><datestamp>2000-01-01</datestamp><setSpec>x</setSpec><setSpec>y</setSpec></header><metadata>a1</metadata></record>
+			<record><header><identifier>b</identifier><datestamp>2000-01-02</datestamp></header><metadata>b1</metadata></record>
+			<record><header><identifier>c</identifier><datestamp>2000-01-03</datestamp></header><metadata>c1</metadata></record>
+		</ListRecords></OAI-PMH>`,
+		`<OAI-PMH><ListRecords>
+			<record><header><identifier>a</identifier><datestamp>2000-01-08</datestamp></header><metadata>a2</metadata></record>
+			<record><header status="deleted"><identifier>b</identifier><datestamp>2000-01-09</datestamp></header></record>
+		</ListRecords></OAI-PMH>`,
+	}
+	var keys []string
+	for i, s := range shards {
+		key := string('a'+rune(i)) + ".xml"
+		if err := ioutil.WriteFile(filepath.Join(dir, key), []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	store := FileStore{Dir: dir}
+
+	var got []string
+	err := eachRecord(store, keys, func(pos position, rec Record) error {
+		if rec.Header.Identifier == "a" && pos.shard == 0 {
+			if want := []string{"x", "y"}; !reflect.DeepEqual(rec.Header.SetSpec, want) {
+				t.Errorf("SetSpec got %v, want %v", rec.Header.SetSpec, want)
+			}
+		}
+		if rec.Header.Identifier == "b" && pos.shard == 1 && !rec.Header.Deleted() {
+			t.Errorf("Deleted() got false, want true")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = snapshot(store, keys, nil, func(rec Record) error {
+		got = append(got, rec.Metadata.Verbatim)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"c1", "a2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshot() got %v, want %v", got, want)
+	}
+}
+
+func TestCopyShard(t *testing.T) {
+	item := func(id, date string) string {
+		return `<record><header><identifier>` + id + `</identifier><datestamp>` + date + `</datestamp></header></record>`
+	}
+	keep := func(h header) bool { return h.Identifier != "b" }
+	var cases = []struct {
+		shard string
+		keep  func(header) bool
+		want  string
+	}{
+		{`<OAI-PMH xmlns="urn:oai"><ListRecords>` + item("a", "2000-01-01") + `</ListRecords></OAI-PMH>`, nil,
+			`<OAI-PMH xmlns="urn:oai"><ListRecords>` + item("a", "2000-01-01") + `</ListRecords></OAI-PMH>`},
+		{`<OAI-PMH><ListRecords>` + item("a", "2000-01-01") + item("b", "2000-01-02") + `</ListRecords></OAI-PMH>`, keep,
+			`<OAI-PMH><ListRecords>` + item("a", "2000-01-01") + `</ListRecords></OAI-PMH>`},
+		{`<Response><ListRecords>` + item("a", "2000-01-01") + `</ListRecords></Response>` +
+			`<Response><ListRecords>` + item("b", "2000-01-02") + `</ListRecords></Response>`, nil,
+			`<OAI-PMH><ListRecords>` + item("a", "2000-01-01") + `</ListRecords></OAI-PMH>` +
+				`<OAI-PMH><ListRecords>` + item("b", "2000-01-02") + `</ListRecords></OAI-PMH>`},
+		{`<Response><ListRecords>` + item("a", "2000-01-01") + item("b", "2000-01-02") + `</ListRecords></Response>`, keep,
+			`<OAI-PMH><ListRecords>` + item("a", "2000-01-01") + `</ListRecords></OAI-PMH>`},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		if err := copyShard(&buf, strings.NewReader(c.shard), c.keep); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != c.want {
+			t.Errorf("copyShard(%s) got %s, want %s", c.shard, buf.String(), c.want)
+		}
+	}
+}
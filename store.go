@@ -0,0 +1,256 @@
+//  Copyright 2015 by Leipzig University Library, http://ub.uni-leipzig.de
+//                    The Finc Authors, http://finc.info
+//                    Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+//
+package oaimi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CacheStore stores the shards of a cache. Keys are slash separated paths
+// relative to the root of the cache, e.g.
+// example.com/oai/ListRecords/oai_dc/2015-01-01-2015-01-07.xml.gz. Stores must
+// be safe for concurrent use.
+type CacheStore interface {
+	// Exists reports whether a key exists and when it was last written.
+	Exists(key string) (modified time.Time, ok bool, err error)
+	// Open returns the content of a key, decompressed, if necessary. A
+	// missing key results in an error, for which os.IsNotExist is true.
+	Open(key string) (io.ReadCloser, error)
+	// Create returns a writer for a key. The content replaces any existing
+	// content on Close, Abort discards it.
+	Create(key string) (ShardWriter, error)
+	// List returns the keys below a directory-like prefix, sorted. An empty
+	// prefix lists all keys.
+	List(prefix string) ([]string, error)
+	// Delete removes a key. Deleting a missing key is not an error.
+	Delete(key string) error
+}
+
+// ShardWriter writes the content of a single key.
+type ShardWriter interface {
+	io.WriteCloser
+	Abort() error
+}
+
+// resumableStore is implemented by stores, that can continue an interrupted
+// write, like FileStore. Besides the writer, the name of the file to keep the
+// checkpoint in is returned.
+type resumableStore interface {
+	CreateResumable(key string) (ShardWriter, string, error)
+}
+
+// sizedStore is implemented by stores, that can tell the stored size of a
+// key, which is needed to limit the size of a cache.
+type sizedStore interface {
+	Size(key string) (int64, error)
+}
+
+// OpenCacheStore returns a store for a location, which is either a cache
+// directory, kv:<filename> for a KVStore or s3://host/bucket/prefix for an
+// S3Store. Use s3+http:// for endpoints without TLS. S3 credentials and
+// region are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_REGION.
+func OpenCacheStore(location string) (CacheStore, error) {
+	switch {
+	case strings.HasPrefix(location, "kv:"):
+		return OpenKVStore(strings.TrimPrefix(location, "kv:"))
+	case strings.HasPrefix(location, "s3://"), strings.HasPrefix(location, "s3+http://"):
+		ref, err := url.Parse(location)
+		if err != nil {
+			return nil, err
+		}
+		scheme := "https"
+		if ref.Scheme == "s3+http" {
+			scheme = "http"
+		}
+		parts := strings.SplitN(strings.Trim(ref.Path, "/"), "/", 2)
+		if ref.Host == "" || parts[0] == "" {
+			return nil, fmt.Errorf("want s3://host/bucket/prefix, got %s", location)
+		}
+		s := NewS3Store(scheme+"://"+ref.Host, parts[0])
+		if len(parts) > 1 {
+			s.Prefix = parts[1]
+		}
+		s.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		s.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		if region := os.Getenv("AWS_REGION"); region != "" {
+			s.Region = region
+		}
+		return s, nil
+	}
+	return FileStore{Dir: location}, nil
+}
+
+// FileStore keeps shards in a directory, with keys as relative paths. This is
+// the default store of a CachingClient.
+type FileStore struct {
+	Dir string
+}
+
+// asFileStore returns a store as FileStore, if it is one, either as value or
+// pointer.
+func asFileStore(store CacheStore) (FileStore, bool) {
+	switch s := store.(type) {
+	case FileStore:
+		return s, true
+	case *FileStore:
+		return *s, true
+	}
+	return FileStore{}, false
+}
+
+// path returns the filename of a key.
+func (s FileStore) path(key string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(key))
+}
+
+func (s FileStore) Exists(key string) (time.Time, bool, error) {
+	fi, err := os.Stat(s.path(key))
+	if os.IsNotExist(err) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return fi.ModTime(), true, nil
+}
+
+func (s FileStore) Open(key string) (io.ReadCloser, error) {
+	return OpenMaybeCompressedFile(s.path(key))
+}
+
+// Create returns a writer for a key. Shards, with keys ending in .gz, may be
+// compressed, other files, like layouts and manifests, are written as is.
+func (s FileStore) Create(key string) (ShardWriter, error) {
+	if !strings.HasSuffix(key, ".gz") {
+		return &atomicFile{filename: s.path(key)}, nil
+	}
+	return CreateMaybeCompressedFile(s.path(key)), nil
+}
+
+// CreateResumable is like Create, but writes to a partial file, which is kept
+// on Abort, see CreateResumableFile.
+func (s FileStore) CreateResumable(key string) (ShardWriter, string, error) {
+	fn := s.path(key)
+	return CreateResumableFile(fn), fn + checkpointSuffix, nil
+}
+
+// List returns the keys of all regular files below a prefix. Partial files
+// and checkpoints of interrupted writes and lock files are not included.
+func (s FileStore) List(prefix string) ([]string, error) {
+	var keys []string
+	root := s.path(prefix)
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		if strings.HasSuffix(p, partSuffix) || strings.HasSuffix(p, checkpointSuffix) || strings.HasSuffix(p, lockSuffix) {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Dir, p)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(rel))
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+func (s FileStore) Size(key string) (int64, error) {
+	fi, err := os.Stat(s.path(key))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (s FileStore) Delete(key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// atomicFile buffers a small file, which replaces the target atomically on
+// Close.
+type atomicFile struct {
+	filename string
+	buf      bytes.Buffer
+}
+
+func (f *atomicFile) Write(p []byte) (int, error) {
+	return f.buf.Write(p)
+}
+
+func (f *atomicFile) Close() error {
+	if err := mkdirAll(filepath.Dir(f.filename)); err != nil {
+		return err
+	}
+	return WriteFileAtomic(f.filename, f.buf.Bytes(), 0644)
+}
+
+func (f *atomicFile) Abort() error {
+	f.buf.Reset()
+	return nil
+}
+
+// EndpointPrefix returns the store key prefix of all cached responses of an
+// endpoint.
+func EndpointPrefix(endpoint string) (string, error) {
+	if !strings.HasPrefix(endpoint, "http") {
+		endpoint = "http://" + endpoint
+	}
+	ref, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if ref.Host == "" {
+		return "", ErrNoHost
+	}
+	return path.Join(ref.Host, ref.Path), nil
+}
+
+// listPrefix turns a directory-like prefix into a prefix for string
+// comparisons.
+func listPrefix(prefix string) string {
+	if prefix == "" || strings.HasSuffix(prefix, "/") {
+		return prefix
+	}
+	return prefix + "/"
+}
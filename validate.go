@@ -0,0 +1,544 @@
+//  Copyright 2015 by Leipzig University Library, http://ub.uni-leipzig.de
+//                    The Finc Authors, http://finc.info
+//                    Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+//
+package oaimi
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	CheckPass = "pass"
+	CheckFail = "fail"
+	// CheckSkip is the status of checks, that could not be performed, e.g.
+	// because the repository has no records.
+	CheckSkip = "skip"
+)
+
+const (
+	oaiDCNamespace = "http://www.openarchives.org/OAI/2.0/oai_dc/"
+	dcNamespace    = "http://purl.org/dc/elements/1.1/"
+	xsiNamespace   = "http://www.w3.org/2001/XMLSchema-instance"
+	xmlNamespace   = "http://www.w3.org/XML/1998/namespace"
+)
+
+// validatePages is the number of ListIdentifiers pages followed, before the
+// resumption token check gives up.
+var validatePages = 50
+
+// dcElements are the elements allowed in oai_dc, according to oai_dc.xsd.
+var dcElements = map[string]bool{
+	"title": true, "creator": true, "subject": true, "description": true,
+	"publisher": true, "contributor": true, "date": true, "type": true,
+	"format": true, "identifier": true, "source": true, "language": true,
+	"relation": true, "coverage": true, "rights": true,
+}
+
+// Check is the result of a single protocol check.
+type Check struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+func checkPass(name string) Check {
+	return Check{Name: name, Status: CheckPass}
+}
+
+func checkFail(name, format string, a ...interface{}) Check {
+	return Check{Name: name, Status: CheckFail, Message: fmt.Sprintf(format, a...)}
+}
+
+func checkSkip(name, format string, a ...interface{}) Check {
+	return Check{Name: name, Status: CheckSkip, Message: fmt.Sprintf(format, a...)}
+}
+
+// Scorecard collects the results of all protocol checks of an endpoint.
+type Scorecard struct {
+	Endpoint string  `json:"endpoint"`
+	Elapsed  float64 `json:"elapsed"`
+	Passed   int     `json:"passed"`
+	Failed   int     `json:"failed"`
+	Skipped  int     `json:"skipped"`
+	// Score is the fraction of passed checks, skipped checks not counted.
+	Score  float64 `json:"score"`
+	Checks []Check `json:"checks"`
+}
+
+// add records the result of a check.
+func (s *Scorecard) add(c Check) {
+	switch c.Status {
+	case CheckPass:
+		s.Passed++
+	case CheckFail:
+		s.Failed++
+	default:
+		s.Skipped++
+	}
+	if s.Passed+s.Failed > 0 {
+		s.Score = float64(s.Passed) / float64(s.Passed+s.Failed)
+	}
+	s.Checks = append(s.Checks, c)
+}
+
+// validator runs protocol checks against an endpoint. Later checks use the
+// Identify response and the headers collected by earlier ones.
+type validator struct {
+	client   Client
+	endpoint string
+	// identified is true, if the Identify response could be decoded.
+	identified bool
+	identify   Identify
+	// headers of the ListIdentifiers responses in oai_dc
+	headers []header
+	// requests and the URLs of malformed responses
+	requests  int
+	malformed []string
+}
+
+// ValidateEndpoint runs a suite of protocol checks against a repository.
+// Execution time limited by timeout.
+func ValidateEndpoint(endpoint string, timeout time.Duration) (*Scorecard, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return ValidateEndpointContext(ctx, endpoint)
+}
+
+// ValidateEndpointContext runs a suite of protocol checks against a
+// repository: error codes for bad verbs and arguments, the Identify response,
+// granularity, from and until, termination of resumption token sequences,
+// datestamps before earliestDatestamp, well-formedness of all responses and
+// conformance of oai_dc records to the rules of oai_dc.xsd.
+func ValidateEndpointContext(ctx context.Context, endpoint string) (*Scorecard, error) {
+	start := time.Now()
+
+	if !strings.HasPrefix(endpoint, "http") {
+		endpoint = "http://" + endpoint
+	}
+	v := &validator{client: NewClient(), endpoint: endpoint}
+	sc := &Scorecard{Endpoint: endpoint, Checks: make([]Check, 0)}
+	defer func() {
+		sc.Elapsed = time.Since(start).Seconds()
+	}()
+
+	checks := []func(context.Context) Check{
+		v.checkIdentify,
+		v.checkBadVerb,
+		v.checkBadArgument,
+		v.checkCannotDisseminateFormat,
+		v.checkBadResumptionToken,
+		v.checkResumptionTokens,
+		v.checkGranularity,
+		v.checkFromUntil,
+		v.checkEarliestDatestamp,
+		v.checkOAIDC,
+	}
+	for _, check := range checks {
+		c := check(ctx)
+		if err := ctx.Err(); err != nil {
+			return sc, err
+		}
+		sc.add(c)
+	}
+	sc.add(v.checkWellFormed())
+	return sc, nil
+}
+
+// isMalformed reports whether an error is caused by a response, that is not
+// well-formed XML.
+func isMalformed(err error) bool {
+	switch err.(type) {
+	case *xml.SyntaxError, *xml.UnmarshalError:
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// fetch sends a request with the given arguments, which need not form a
+// valid OAI request.
+func (v *validator) fetch(ctx context.Context, args url.Values) (Response, []byte, error) {
+	link := fmt.Sprintf("%s?%s", v.endpoint, args.Encode())
+	v.requests++
+	resp, page, err := v.client.fetchURL(ctx, link)
+	if err != nil && isMalformed(err) {
+		v.malformed = append(v.malformed, link)
+	}
+	return resp, page, err
+}
+
+// unexpected turns an unexpected error into a check result. Only protocol
+// errors and malformed responses fail a check.
+func (v *validator) unexpected(name string, err error) Check {
+	if isMalformed(err) {
+		return checkFail(name, "malformed response: %s", err)
+	}
+	if e, ok := err.(OAIError); ok {
+		return checkFail(name, "unexpected error %s", e)
+	}
+	return checkSkip(name, "request failed: %s", err)
+}
+
+// layout returns the datestamp layout of the declared granularity.
+func (v *validator) layout() (string, bool) {
+	switch strings.TrimSpace(v.identify.Granularity) {
+	case GranularityDay:
+		return "2006-01-02", true
+	case GranularitySecond:
+		return "2006-01-02T15:04:05Z", true
+	}
+	return "", false
+}
+
+// expectError checks, that each request results in an error with the given
+// code.
+func (v *validator) expectError(ctx context.Context, name, code string, requests ...url.Values) Check {
+	for _, args := range requests {
+		_, _, err := v.fetch(ctx, args)
+		if err == nil {
+			return checkFail(name, "got no error for %s, want %s", args.Encode(), code)
+		}
+		e, ok := err.(OAIError)
+		if !ok {
+			return v.unexpected(name, err)
+		}
+		if e.Code != code {
+			return checkFail(name, "got %s for %s, want %s", e.Code, args.Encode(), code)
+		}
+	}
+	return checkPass(name)
+}
+
+func (v *validator) checkIdentify(ctx context.Context) Check {
+	const name = "identify"
+	resp, _, err := v.fetch(ctx, url.Values{"verb": {"Identify"}})
+	if err != nil {
+		return checkFail(name, "Identify failed: %s", err)
+	}
+	v.identified, v.identify = true, resp.Identify
+	id := resp.Identify
+	var problems []string
+	if strings.TrimSpace(id.Name) == "" {
+		problems = append(problems, "repositoryName missing")
+	}
+	if strings.TrimSpace(id.URL) == "" {
+		problems = append(problems, "baseURL missing")
+	}
+	if strings.TrimSpace(id.AdminEmail) == "" {
+		problems = append(problems, "adminEmail missing")
+	}
+	if s := strings.TrimSpace(id.Version); s != "2.0" {
+		problems = append(problems, fmt.Sprintf("protocolVersion is %q, want 2.0", s))
+	}
+	switch s := strings.TrimSpace(id.DeletePolicy); s {
+	case "no", "persistent", "transient":
+	default:
+		problems = append(problems, fmt.Sprintf("deletedRecord is %q", s))
+	}
+	if layout, ok := v.layout(); !ok {
+		problems = append(problems, fmt.Sprintf("granularity is %q", id.Granularity))
+	} else if _, err := time.Parse(layout, strings.TrimSpace(id.EarliestDatestamp)); err != nil {
+		problems = append(problems, fmt.Sprintf("earliestDatestamp %q does not match granularity", id.EarliestDatestamp))
+	}
+	if len(problems) > 0 {
+		return checkFail(name, "%s", strings.Join(problems, "; "))
+	}
+	return checkPass(name)
+}
+
+func (v *validator) checkBadVerb(ctx context.Context) Check {
+	return v.expectError(ctx, "bad-verb", "badVerb",
+		url.Values{"verb": {"oaimiNoSuchVerb"}},
+		url.Values{})
+}
+
+func (v *validator) checkBadArgument(ctx context.Context) Check {
+	return v.expectError(ctx, "bad-argument", "badArgument",
+		url.Values{"verb": {"Identify"}, "oaimi": {"x"}},
+		url.Values{"verb": {"ListRecords"}},
+		url.Values{"verb": {"GetRecord"}, "metadataPrefix": {"oai_dc"}},
+		url.Values{"verb": {"ListIdentifiers"}, "metadataPrefix": {"oai_dc"}, "from": {"oaimi"}})
+}
+
+func (v *validator) checkCannotDisseminateFormat(ctx context.Context) Check {
+	return v.expectError(ctx, "cannot-disseminate-format", "cannotDisseminateFormat",
+		url.Values{"verb": {"ListRecords"}, "metadataPrefix": {"oaimiNoSuchFormat"}})
+}
+
+func (v *validator) checkBadResumptionToken(ctx context.Context) Check {
+	return v.expectError(ctx, "bad-resumption-token", "badResumptionToken",
+		url.Values{"verb": {"ListIdentifiers"}, "resumptionToken": {"oaimiNoSuchToken"}})
+}
+
+// checkResumptionTokens follows the ListIdentifiers list in oai_dc and
+// collects the headers for later checks. A list fails to terminate, if a
+// token is repeated or a page only repeats earlier items.
+func (v *validator) checkResumptionTokens(ctx context.Context) Check {
+	const name = "resumption-tokens"
+	args := url.Values{"verb": {"ListIdentifiers"}, "metadataPrefix": {"oai_dc"}}
+	tokens := make(map[string]bool)
+	identifiers := make(map[string]bool)
+	for i := 1; i <= validatePages; i++ {
+		resp, _, err := v.fetch(ctx, args)
+		if e, ok := err.(OAIError); ok && e.Code == "noRecordsMatch" && i == 1 {
+			return checkSkip(name, "no records")
+		}
+		if err != nil {
+			return v.unexpected(name, err)
+		}
+		var fresh int
+		for _, h := range resp.ListIdentifiers.Header {
+			if !identifiers[h.Identifier] {
+				identifiers[h.Identifier] = true
+				fresh++
+			}
+		}
+		v.headers = append(v.headers, resp.ListIdentifiers.Header...)
+		token := strings.TrimSpace(resp.ListIdentifiers.Token.Value)
+		if token == "" {
+			return checkPass(name)
+		}
+		if tokens[token] {
+			return checkFail(name, "token %q repeated on page %d", token, i)
+		}
+		if fresh == 0 && len(resp.ListIdentifiers.Header) > 0 {
+			return checkFail(name, "page %d only repeats earlier items", i)
+		}
+		tokens[token] = true
+		args = url.Values{"verb": {"ListIdentifiers"}, "resumptionToken": {token}}
+	}
+	return checkSkip(name, "list not complete after %d pages", validatePages)
+}
+
+// checkGranularity checks, that datestamps use the declared granularity and
+// that a repository with day granularity rejects finer from arguments.
+func (v *validator) checkGranularity(ctx context.Context) Check {
+	const name = "granularity"
+	if !v.identified {
+		return checkSkip(name, "no Identify response")
+	}
+	layout, ok := v.layout()
+	if !ok {
+		return checkFail(name, "unknown granularity %q", v.identify.Granularity)
+	}
+	for _, h := range v.headers {
+		if _, err := time.Parse(layout, strings.TrimSpace(h.Datestamp)); err != nil {
+			return checkFail(name, "datestamp %q of %s does not match granularity %s",
+				h.Datestamp, h.Identifier, v.identify.Granularity)
+		}
+	}
+	t, err := time.Parse(layout, strings.TrimSpace(v.identify.EarliestDatestamp))
+	if err != nil {
+		t = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	from := t.Format("2006-01-02T15:04:05Z")
+	args := url.Values{"verb": {"ListIdentifiers"}, "metadataPrefix": {"oai_dc"}, "from": {from}}
+	if layout == "2006-01-02" {
+		return v.expectError(ctx, name, "badArgument", args)
+	}
+	_, _, err = v.fetch(ctx, args)
+	if e, ok := err.(OAIError); ok && e.Code == "noRecordsMatch" {
+		return checkPass(name)
+	}
+	if err != nil {
+		return v.unexpected(name, err)
+	}
+	return checkPass(name)
+}
+
+// checkFromUntil requests the items with the datestamp of the first item
+// found and checks, that all returned items are within the requested range.
+func (v *validator) checkFromUntil(ctx context.Context) Check {
+	const name = "from-until"
+	if len(v.headers) == 0 {
+		return checkSkip(name, "no records")
+	}
+	sample := v.headers[0]
+	datestamp := strings.TrimSpace(sample.Datestamp)
+	from, err := ParseDatestamp(datestamp)
+	if err != nil {
+		return checkSkip(name, "cannot parse datestamp %q", sample.Datestamp)
+	}
+	until := from
+	if len(datestamp) == len("2006-01-02") {
+		until = from.Add(24*time.Hour - time.Nanosecond)
+	}
+	resp, _, err := v.fetch(ctx, url.Values{"verb": {"ListIdentifiers"}, "metadataPrefix": {"oai_dc"},
+		"from": {datestamp}, "until": {datestamp}})
+	if e, ok := err.(OAIError); ok && e.Code == "noRecordsMatch" {
+		return checkFail(name, "no records for from=until=%s, but %s has this datestamp", datestamp, sample.Identifier)
+	}
+	if err != nil {
+		return v.unexpected(name, err)
+	}
+	var found bool
+	for _, h := range resp.ListIdentifiers.Header {
+		t, err := ParseDatestamp(h.Datestamp)
+		if err != nil {
+			continue
+		}
+		if t.Before(from) || t.After(until) {
+			return checkFail(name, "%s with datestamp %s returned for from=until=%s", h.Identifier, h.Datestamp, datestamp)
+		}
+		if h.Identifier == sample.Identifier {
+			found = true
+		}
+	}
+	if !found && strings.TrimSpace(resp.ListIdentifiers.Token.Value) == "" {
+		return checkFail(name, "%s missing for from=until=%s", sample.Identifier, datestamp)
+	}
+	return checkPass(name)
+}
+
+func (v *validator) checkEarliestDatestamp(ctx context.Context) Check {
+	const name = "earliest-datestamp"
+	if !v.identified {
+		return checkSkip(name, "no Identify response")
+	}
+	if len(v.headers) == 0 {
+		return checkSkip(name, "no records")
+	}
+	earliest, err := ParseDatestamp(v.identify.EarliestDatestamp)
+	if err != nil {
+		return checkFail(name, "cannot parse earliestDatestamp %q", v.identify.EarliestDatestamp)
+	}
+	for _, h := range v.headers {
+		t, err := ParseDatestamp(h.Datestamp)
+		if err != nil {
+			continue
+		}
+		if t.Before(earliest) {
+			return checkFail(name, "%s has datestamp %s before earliestDatestamp %s",
+				h.Identifier, h.Datestamp, v.identify.EarliestDatestamp)
+		}
+	}
+	return checkPass(name)
+}
+
+// checkOAIDC validates the records of the first ListRecords page in oai_dc.
+func (v *validator) checkOAIDC(ctx context.Context) Check {
+	const name = "oai-dc"
+	_, page, err := v.fetch(ctx, url.Values{"verb": {"ListRecords"}, "metadataPrefix": {"oai_dc"}})
+	if e, ok := err.(OAIError); ok && e.Code == "noRecordsMatch" {
+		return checkSkip(name, "no records")
+	}
+	if err != nil {
+		return v.unexpected(name, err)
+	}
+	problems, err := validateOAIDC(page)
+	if err != nil {
+		return checkFail(name, "malformed response: %s", err)
+	}
+	if len(problems) > 0 {
+		return checkFail(name, "%s", strings.Join(problems, "; "))
+	}
+	return checkPass(name)
+}
+
+func (v *validator) checkWellFormed() Check {
+	const name = "well-formed"
+	switch {
+	case len(v.malformed) > 0:
+		return checkFail(name, "%d of %d responses malformed, e.g. %s", len(v.malformed), v.requests, v.malformed[0])
+	case v.requests == 0:
+		return checkSkip(name, "no responses")
+	}
+	return checkPass(name)
+}
+
+// validateOAIDC checks the metadata of all records in a response against the
+// rules of oai_dc.xsd: a single oai_dc:dc element, which contains only the
+// fifteen Dublin Core elements with text content and an optional xml:lang.
+// At most ten problems are reported.
+func validateOAIDC(page []byte) ([]string, error) {
+	dec := xml.NewDecoder(bytes.NewReader(page))
+	dec.CharsetReader = CharsetReader
+	var (
+		problems   []string
+		path       []string
+		identifier string
+		// metadata is the depth of the current metadata element or -1
+		metadata = -1
+		roots    int
+	)
+	report := func(format string, a ...interface{}) {
+		if len(problems) < 10 {
+			problems = append(problems, fmt.Sprintf("%s: ", identifier)+fmt.Sprintf(format, a...))
+		}
+	}
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return problems, nil
+		}
+		if err != nil {
+			return problems, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch {
+			case metadata < 0:
+			case len(path) == metadata+1:
+				if roots++; roots > 1 {
+					report("more than one element in metadata")
+				}
+				if t.Name.Space != oaiDCNamespace || t.Name.Local != "dc" {
+					report("metadata root is {%s}%s, want oai_dc:dc", t.Name.Space, t.Name.Local)
+				}
+			case len(path) == metadata+2:
+				if t.Name.Space != dcNamespace || !dcElements[t.Name.Local] {
+					report("element {%s}%s not allowed in oai_dc:dc", t.Name.Space, t.Name.Local)
+				}
+				for _, attr := range t.Attr {
+					switch {
+					case attr.Name.Space == xmlNamespace && attr.Name.Local == "lang":
+					case attr.Name.Space == xsiNamespace, attr.Name.Space == "xmlns", attr.Name.Local == "xmlns":
+					default:
+						report("attribute %s not allowed in dc:%s", attr.Name.Local, t.Name.Local)
+					}
+				}
+			default:
+				report("element %s not allowed in dc:%s", t.Name.Local, path[metadata+2])
+			}
+			path = append(path, t.Name.Local)
+			if n := len(path); metadata < 0 && t.Name.Local == "metadata" && n > 1 && path[n-2] == "record" {
+				metadata, roots = n-1, 0
+			}
+		case xml.EndElement:
+			if len(path) > 0 {
+				path = path[:len(path)-1]
+			}
+			if len(path) == metadata {
+				metadata = -1
+			}
+		case xml.CharData:
+			if n := len(path); n > 1 && metadata < 0 && path[n-2] == "header" && path[n-1] == "identifier" {
+				identifier = strings.TrimSpace(string(t))
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package oaimi
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/miku/oaimi/oaitest"
+)
+
+func TestValidateEndpoint(t *testing.T) {
+	records := testRecords(5)
+	records[1].Metadata = `<oai_dc:dc xmlns:oai_dc="http://www.openarchives.org/OAI/2.0/oai_dc/" ` +
+		`xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:title xml:lang="en">x</dc:title>` +
+		`<dc:heading>y</dc:heading></oai_dc:dc>`
+
+	var tests = []struct {
+		config oaitest.Config
+		failed []string
+	}{
+		{oaitest.Config{Records: testRecords(5), PageSize: 2}, nil},
+		{oaitest.Config{Records: testRecords(5), PageSize: 2, Granularity: GranularitySecond}, nil},
+		{oaitest.Config{Records: testRecords(5), PageSize: 2, Faults: oaitest.Faults{EndlessTokens: true}},
+			[]string{"resumption-tokens"}},
+		{oaitest.Config{Records: records, PageSize: 2}, []string{"oai-dc"}},
+	}
+	for _, test := range tests {
+		ts := oaitest.NewServer(test.config)
+		sc, err := ValidateEndpointContext(context.Background(), ts.URL)
+		ts.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var failed []string
+		for _, c := range sc.Checks {
+			if c.Status == CheckFail {
+				failed = append(failed, c.Name)
+			}
+		}
+		if strings.Join(failed, ",") != strings.Join(test.failed, ",") {
+			t.Errorf("got failed checks %v, want %v: %+v", failed, test.failed, sc.Checks)
+		}
+		if sc.Skipped != 0 {
+			t.Errorf("got %d skipped checks, want 0: %+v", sc.Skipped, sc.Checks)
+		}
+	}
+}
+
+func TestValidateOAIDC(t *testing.T) {
+	page := `<OAI-PMH><ListRecords><record><header><identifier>a</identifier></header><metadata>` +
+		`<oai_dc:dc xmlns:oai_dc="http://www.openarchives.org/OAI/2.0/oai_dc/" xmlns:dc="http://purl.org/dc/elements/1.1/" ` +
+		`xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:schemaLocation="x">` +
+		`<dc:title xml:lang="de">T</dc:title><dc:creator id="1">C<b>old</b></dc:creator></oai_dc:dc>` +
+		`</metadata></record><record><header><identifier>b</identifier></header>` +
+		`<metadata><dc/></metadata></record></ListRecords></OAI-PMH>`
+	problems, err := validateOAIDC([]byte(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 3 {
+		t.Fatalf("got %d problems, want 3: %v", len(problems), problems)
+	}
+	for i, prefix := range []string{"a: attribute id", "a: element b", "b: metadata root"} {
+		if !strings.HasPrefix(problems[i], prefix) {
+			t.Errorf("got %q, want prefix %q", problems[i], prefix)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+//  Copyright 2015 by Leipzig University Library, http://ub.uni-leipzig.de
+//                    The Finc Authors, http://finc.info
+//                    Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+//
+package oaimi
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// ErrNoManifestEntry is returned, if a shard cannot be retrieved again,
+// because its request is not recorded in a manifest.
+var ErrNoManifestEntry = errors.New("shard not recorded in manifest")
+
+// ShardError describes a damaged shard.
+type ShardError struct {
+	Key    string
+	Reason string
+}
+
+func (e *ShardError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Key, e.Reason)
+}
+
+// gzipMagic starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// checkCompression looks for damaged gzip headers, which
+// OpenMaybeCompressedFile would silently read as plain data. Shards are only
+// written uncompressed, if they are smaller than CompressThreshold.
+func checkCompression(filename string) (reason string, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	if bytes.Equal(magic, gzipMagic) {
+		if _, err := gzip.NewReader(br); err != nil {
+			return fmt.Sprintf("bad gzip header: %s", err), nil
+		}
+		return "", nil
+	}
+	if fi.Size() >= CompressThreshold {
+		return fmt.Sprintf("%d bytes uncompressed, gzip header missing", fi.Size()), nil
+	}
+	return "", nil
+}
+
+// VerifyShard checks, that a shard decompresses completely, parses as XML and
+// matches the checksum and record count of its manifest entry, if there is
+// one. Returns a *ShardError for a damaged shard, other errors stem from the
+// store.
+func VerifyShard(store CacheStore, shard CachedShard) error {
+	if fs, ok := asFileStore(store); ok {
+		reason, err := checkCompression(fs.path(shard.Key))
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			return &ShardError{Key: shard.Key, Reason: reason}
+		}
+	}
+	rc, err := store.Open(shard.Key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, sum, records, err := readShard(rc)
+	if err != nil {
+		return &ShardError{Key: shard.Key, Reason: err.Error()}
+	}
+	si := shard.Info
+	if si == nil || si.SHA256 == "" {
+		return nil
+	}
+	if sum != si.SHA256 {
+		return &ShardError{Key: shard.Key, Reason: fmt.Sprintf("checksum %s, manifest %s", sum, si.SHA256)}
+	}
+	if records != si.Records {
+		return &ShardError{Key: shard.Key, Reason: fmt.Sprintf("%d records, manifest %d", records, si.Records)}
+	}
+	return nil
+}
+
+// DeleteShard removes a shard and its manifest entry. The manifest and layout
+// of a request are removed together with its last shard.
+func DeleteShard(store CacheStore, key string) error {
+	dir := path.Dir(key)
+	if ls, ok := store.(lockingStore); ok {
+		unlock, err := ls.Lock(context.Background(), path.Join(dir, ManifestFilename))
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	if err := store.Delete(key); err != nil {
+		return err
+	}
+	keys, err := store.List(dir)
+	if err != nil {
+		return err
+	}
+	var left int
+	for _, k := range keys {
+		if path.Dir(k) == dir && strings.HasSuffix(k, ".xml.gz") {
+			left++
+		}
+	}
+	return pruneManifests(store, map[string]int{dir: left}, map[string]string{key: "deleted"})
+}
+
+// RepairShard retrieves a shard again, with the request recorded in the
+// manifest. The damaged shard is only replaced, if the retrieval succeeds.
+func (c CachingClient) RepairShard(ctx context.Context, key string) error {
+	store := c.store()
+	m, err := ReadManifest(store, path.Dir(key))
+	if err != nil {
+		return err
+	}
+	si, ok := m.find(path.Base(key))
+	if !ok || m.Endpoint == "" {
+		return ErrNoManifestEntry
+	}
+	req := Request{
+		Endpoint:    m.Endpoint,
+		Verb:        m.Verb,
+		Prefix:      m.Prefix,
+		Set:         m.Set,
+		From:        si.From,
+		Until:       si.Until,
+		Granularity: m.Granularity,
+	}
+	if req.Granularity == "" {
+		req.UseDefaultsContext(ctx)
+	}
+	if k, err := shardKey(req); err != nil {
+		return err
+	} else if k != key {
+		return fmt.Errorf("manifest entry of %s describes %s", key, k)
+	}
+	_, info, err := c.retrieve(ctx, req, true)
+	if info != nil {
+		if merr := updateManifest(store, req, []ShardInfo{*info}); merr != nil && err == nil {
+			err = merr
+		}
+	}
+	return err
+}
@@ -0,0 +1,155 @@
+package oaimi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miku/oaimi/oaitest"
+)
+
+func TestVerifyShard(t *testing.T) {
+	var failing int32
+	h := oaitest.NewHandler(oaitest.Config{Records: testRecords(40), PageSize: 4})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			fmt.Fprint(w, `<OAI-PMH><error code="badArgument">unavailable</error></OAI-PMH>`)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	c := NewCachingClientDir(ioutil.Discard, t.TempDir())
+	req := Request{
+		Endpoint:    ts.URL,
+		Verb:        "ListRecords",
+		Prefix:      "oai_dc",
+		From:        time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		Until:       time.Date(2000, 1, 31, 0, 0, 0, 0, time.UTC),
+		Granularity: GranularityDay,
+	}
+	if err := c.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	store := FileStore{Dir: c.CacheDir}
+	shards, err := ListShards(store, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var damage = []func(b []byte) []byte{
+		// truncated
+		func(b []byte) []byte { return b[:len(b)/2] },
+		// damaged gzip header, which would be read as plain data
+		func(b []byte) []byte { return append([]byte{0, 0}, b[2:]...) },
+	}
+	var damaged []string
+	for _, shard := range shards {
+		if err := VerifyShard(store, shard); err != nil {
+			t.Fatalf("VerifyShard(%s) got %v, want nil", shard.Key, err)
+		}
+		fn := store.path(shard.Key)
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(damage) == 0 || !bytes.HasPrefix(b, gzipMagic) {
+			continue
+		}
+		if err := ioutil.WriteFile(fn, damage[0](b), 0644); err != nil {
+			t.Fatal(err)
+		}
+		damage = damage[1:]
+		damaged = append(damaged, shard.Key)
+	}
+	if len(damaged) != 2 {
+		t.Fatalf("got %d compressed shards, want 2", len(damaged))
+	}
+	shards, err = ListShards(store, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bad []string
+	for _, shard := range shards {
+		err := VerifyShard(store, shard)
+		if _, ok := err.(*ShardError); ok {
+			bad = append(bad, shard.Key)
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(bad) != 2 || bad[0] != damaged[0] || bad[1] != damaged[1] {
+		t.Errorf("VerifyShard() found %v, want %v", bad, damaged)
+	}
+	// a failed repair keeps the damaged shard
+	atomic.StoreInt32(&failing, 1)
+	before, err := ioutil.ReadFile(store.path(damaged[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RepairShard(context.Background(), damaged[0]); err == nil {
+		t.Errorf("RepairShard() with failing repository got nil error")
+	}
+	if after, err := ioutil.ReadFile(store.path(damaged[0])); err != nil || !bytes.Equal(after, before) {
+		t.Errorf("failed repair changed shard: %v", err)
+	}
+	atomic.StoreInt32(&failing, 0)
+	for _, key := range damaged {
+		if err := c.RepairShard(context.Background(), key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	shards, err = ListShards(store, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, shard := range shards {
+		if err := VerifyShard(store, shard); err != nil {
+			t.Errorf("VerifyShard(%s) after repair got %v", shard.Key, err)
+		}
+	}
+	if _, err := os.Stat(store.path(damaged[0])); err != nil {
+		t.Errorf("repaired shard missing: %v", err)
+	}
+
+	// deleted shards leave no manifest entries behind, the last one takes the
+	// manifest along
+	for _, shard := range shards {
+		if err := DeleteShard(&store, shard.Key); err != nil {
+			t.Fatal(err)
+		}
+		m, err := ReadManifest(store, path.Dir(shard.Key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m.find(path.Base(shard.Key)); ok {
+			t.Errorf("manifest entry of deleted shard %s kept", shard.Key)
+		}
+	}
+	prefix, _ := shardPrefix(req)
+	if keys, _ := store.List(prefix); len(keys) != 0 {
+		t.Errorf("got %v after deleting all shards, want nothing", keys)
+	}
+}
+
+func TestVerifyShardFileStorePointer(t *testing.T) {
+	// a large shard without gzip header parses fine, but has been damaged
+	store := &FileStore{Dir: t.TempDir()}
+	body := `<OAI-PMH><ListRecords>` + strings.Repeat("<!-- padding -->", 100) + `</ListRecords></OAI-PMH>`
+	if err := ioutil.WriteFile(store.path("a.xml.gz"), []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := VerifyShard(store, CachedShard{Key: "a.xml.gz"})
+	if e, ok := err.(*ShardError); !ok || !strings.Contains(e.Reason, "gzip header missing") {
+		t.Errorf("VerifyShard() got %v, want missing gzip header", err)
+	}
+}